@@ -0,0 +1,55 @@
+// Copyright 2015 Michael Johnson. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// adminToken grants access to diagnostic features when presented as a bearer
+// token. Admin access is disabled when it is empty.
+var adminToken string
+
+func isAdmin(r *http.Request) bool {
+	if adminToken == "" {
+		return false
+	}
+
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) == 1
+}
+
+// serveStats reports the service's internal state to admins.
+func serveStats(w http.ResponseWriter, r *http.Request) {
+	h := w.Header()
+	h.Set("Content-Type", "application/json; charset=utf-8")
+	h.Set("Cache-Control", "private, no-store")
+
+	if !isAdmin(r) {
+		httpError(w, adminOnlyError, http.StatusForbidden)
+		return
+	}
+
+	stats := &struct {
+		Cache *cacheStats `json:"cache"`
+	}{memoryStats()}
+
+	if stats.Cache == nil && responseCache != nil {
+		// External caches report their own usage.
+		stats.Cache = &cacheStats{Backend: "redis"}
+	}
+
+	fmt.Fprintln(w, mustJSONEncode(&struct {
+		Version string      `json:"apiVersion"`
+		Data    interface{} `json:"data"`
+	}{apiVersion, stats}))
+}
@@ -0,0 +1,265 @@
+// Copyright 2015 Michael Johnson. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// maxBatchSize is the largest number of domains a batch may contain.
+	maxBatchSize = 100
+
+	// batchConcurrency is the number of domains in a batch resolved at
+	// once.
+	batchConcurrency = 8
+)
+
+// batchResult is the response for one domain in a batch. Result is exactly
+// the body the domain's own URL would have returned.
+type batchResult struct {
+	Domain string          `json:"domain"`
+	Result json.RawMessage `json:"result"`
+
+	// expires is when a successful result stops being fresh.
+	expires time.Time
+
+	// code is the status the domain's own URL would have returned.
+	code int
+}
+
+// resolveBatch resolves each domain, sending the results on the returned
+// channel as they complete. The channel is closed once all are done.
+func resolveBatch(r *http.Request, domains []string, opts *options) <-chan *batchResult {
+	var (
+		ctx     = opts.context(r.Context())
+		results = make(chan *batchResult)
+		slots   = make(chan struct{}, batchConcurrency)
+		wg      sync.WaitGroup
+	)
+
+	for _, domain := range domains {
+		wg.Add(1)
+		go func(domain string) {
+			defer wg.Done()
+
+			slots <- struct{}{}
+			defer func() { <-slots }()
+
+			domainRequests.observe(strings.ToLower(domain))
+
+			res := &batchResult{Domain: domain, code: http.StatusOK}
+			if entry, _, rerr := cachedResponse(ctx, domain, opts); rerr != nil {
+				res.Result, res.code = json.RawMessage(rerr.body), rerr.code
+			} else {
+				res.Result, res.expires = entry.Body, entry.Expires
+			}
+
+			results <- res
+		}(domain)
+	}
+
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	return results
+}
+
+// serveBatch resolves a JSON array of domains POSTed to it, or the domain
+// parameters of a GET, with the options given in the query string applying to
+// all of them. The response maps each domain to its result, or with Accept:
+// application/x-ndjson, streams one batchResult per line as each domain
+// completes.
+func serveBatch(w http.ResponseWriter, r *http.Request) {
+	if servePreflight(w, r, "GET", "HEAD", "POST") {
+		return
+	}
+
+	if r.Method != "POST" && r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, fmt.Sprintf("This resource does not accept %s requests.", r.Method), http.StatusMethodNotAllowed)
+		return
+	}
+
+	h := w.Header()
+	h.Set("Content-Type", "application/json; charset=utf-8")
+	allowCrossOrigin(h)
+
+	query := r.URL.Query()
+	warnDeprecated(h, query)
+
+	opts, rerr := requestOptions(r, query)
+	if rerr != nil {
+		httpError(w, rerr.body, rerr.code)
+		return
+	}
+
+	// Each result is embedded in the batch's JSON, whatever the format
+	// parameter asks for.
+	opts.format = jsonFormat
+
+	var domains []string
+	if r.Method == "POST" {
+		if domains, rerr = readBatchBody(w, r); rerr != nil {
+			httpError(w, rerr.body, rerr.code)
+			return
+		}
+	} else {
+		h.Set("Vary", "Accept")
+
+		if domains = query["domain"]; len(domains) == 0 {
+			httpError(w, errorJSON(http.StatusBadRequest, "The domain parameter must be given at least once."), http.StatusBadRequest)
+			return
+		}
+	}
+
+	domains = uniqueDomains(domains)
+	if len(domains) > maxBatchSize {
+		httpError(w, batchTooLargeError(), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	results := resolveBatch(r, domains, opts)
+
+	if strings.Contains(r.Header.Get("Accept"), "application/x-ndjson") {
+		h.Set("Content-Type", "application/x-ndjson")
+		flusher, _ := w.(http.Flusher)
+
+		for res := range results {
+			line, err := json.Marshal(res)
+			if err != nil {
+				log.Fatalf("Error marshalling JSON for %q: %v", res.Domain, err)
+			}
+
+			w.Write(append(line, '\n'))
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+
+		return
+	}
+
+	var (
+		data      = make(map[string]json.RawMessage, len(domains))
+		expires   = time.Now().Add(time.Duration(maxAgeFor(unknownTTL)) * time.Second)
+		transient = false
+	)
+
+	for res := range results {
+		data[res.Domain] = res.Result
+		if !res.expires.IsZero() && res.expires.Before(expires) {
+			expires = res.expires
+		}
+
+		transient = transient || res.code >= http.StatusInternalServerError
+	}
+
+	// Keys are marshalled in sorted order, so the same results always
+	// give the same body and ETag.
+	body := mustJSONEncode(&struct {
+		Version string                     `json:"apiVersion"`
+		Data    map[string]json.RawMessage `json:"data"`
+	}{apiVersion, data}) + "\n"
+
+	if r.Method == "POST" {
+		w.Write([]byte(body))
+		return
+	}
+
+	// A GET is cacheable for as long as every result in it is, and
+	// conditional, with the ETag of the whole body. As with a single
+	// domain, shuffled batches are kept out of shared caches, and one with
+	// a failure that may be momentary isn't cached at all.
+	switch {
+	case opts.diagnostic() || opts.debugErrors:
+		h.Set("Cache-Control", "private, no-store")
+	case transient:
+		h.Set("Cache-Control", "no-store")
+	default:
+		visibility := "public"
+		if opts.shuffle {
+			visibility = "private"
+		}
+
+		remaining := max(int(math.Ceil(time.Until(expires).Seconds())), 0)
+		h.Set("Cache-Control", visibility+", max-age="+strconv.Itoa(remaining))
+	}
+
+	etag := etagFor([]byte(body))
+	h.Set("ETag", etag)
+
+	if r.Header.Get("If-None-Match") == "" && opts.etag != "" && etagMatches(opts.etag, etag) {
+		h.Del("Content-Type")
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	http.ServeContent(w, r, "batch", time.Time{}, strings.NewReader(body))
+}
+
+// readBatchBody reads the JSON array of domains POSTed as a batch.
+//
+// Everything that can be checked from the headers is checked before the body
+// is read, as the server only sends 100 Continue to a client using Expect:
+// 100-continue once the handler starts reading. Other Expect values are
+// answered with 417 by net/http itself.
+func readBatchBody(w http.ResponseWriter, r *http.Request) ([]string, *requestError) {
+	limit := maxBatchBodySize()
+	if r.ContentLength > limit {
+		return nil, &requestError{http.StatusRequestEntityTooLarge, batchTooLargeError()}
+	}
+
+	var domains []string
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, limit)).Decode(&domains); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return nil, &requestError{http.StatusRequestEntityTooLarge, batchTooLargeError()}
+		}
+
+		return nil, &requestError{http.StatusBadRequest, errorJSON(http.StatusBadRequest, "The request body must be a JSON array of domain names.")}
+	}
+
+	return domains, nil
+}
+
+// maxBatchBodySize returns the largest request body a batch of maxBatchSize
+// domains can need: each at most 253 characters, quoted, and separated by a
+// comma and some whitespace.
+func maxBatchBodySize() int64 {
+	return int64(maxBatchSize)*(253+2+1+4) + 16
+}
+
+func batchTooLargeError() string {
+	return errorJSON(http.StatusRequestEntityTooLarge, fmt.Sprintf("A batch may contain at most %d domains.", maxBatchSize))
+}
+
+// uniqueDomains removes empty and repeated domains, as results are keyed by
+// domain.
+func uniqueDomains(domains []string) []string {
+	seen := make(map[string]bool, len(domains))
+	out := domains[:0]
+
+	for _, d := range domains {
+		if d == "" || seen[d] {
+			continue
+		}
+
+		seen[d] = true
+		out = append(out, d)
+	}
+
+	return out
+}
@@ -0,0 +1,99 @@
+// Copyright 2015 Michael Johnson. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBatchCacheControl(t *testing.T) {
+	useFixtures(t,
+		srvFixture("_xmpp-client._tcp.example.test", 0, 0, 5222, "xmpp.example.test"),
+		fixture{"_xmppconnect.badtxt.test", dnsTypeTXT, 60, []byte{20, 'a', 'b'}},
+	)
+
+	tests := []struct {
+		query, want string
+	}{
+		{"domain=example.test", "public, max-age=300"},
+		{"domain=example.test&domain=missing.test", "public, max-age=300"},
+		{"domain=example.test&domain=badtxt.test", "no-store"},
+		{"domain=badtxt.test", "no-store"},
+		{"domain=example.test&shuffle=true", "private, max-age=300"},
+		{"domain=example.test&client-key=alice", "private, max-age=300"},
+	}
+
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		serveBatch(w, httptest.NewRequest("GET", "/batch?"+tt.query, nil))
+
+		if got := w.Header().Get("Cache-Control"); got != tt.want {
+			t.Errorf("%s: Cache-Control = %q, want %q", tt.query, got, tt.want)
+		}
+	}
+}
+
+// unreadBody fails the test if it is read.
+type unreadBody struct{ t *testing.T }
+
+func (b unreadBody) Read(p []byte) (int, error) {
+	b.t.Error("the body was read")
+	return 0, io.EOF
+}
+
+func TestBatchTooLarge(t *testing.T) {
+	r := httptest.NewRequest("POST", "/batch", unreadBody{t})
+	r.ContentLength = maxBatchBodySize() + 1
+
+	w := httptest.NewRecorder()
+	serveBatch(w, r)
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("status %d, want 413", w.Code)
+	}
+
+	// A body without a declared length is cut off at the same size.
+	r = httptest.NewRequest("POST", "/batch", strings.NewReader(`["`+strings.Repeat("a", int(maxBatchBodySize()))+`"]`))
+	r.ContentLength = -1
+
+	w = httptest.NewRecorder()
+	serveBatch(w, r)
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("chunked: status %d, want 413", w.Code)
+	}
+}
+
+func TestBatchExpectContinue(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(serveBatch))
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", s.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// The client waits for 100 Continue before sending the body, so the
+	// 413 must come first.
+	fmt.Fprintf(conn, "POST /batch HTTP/1.1\r\nHost: example.test\r\nContent-Type: application/json\r\nExpect: 100-continue\r\nContent-Length: %d\r\n\r\n", maxBatchBodySize()+1)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("status %d, want 413 without 100 Continue", resp.StatusCode)
+	}
+}
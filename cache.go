@@ -0,0 +1,314 @@
+// Copyright 2015 Michael Johnson. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"container/list"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cacheEntry is an encoded response ready to be served.
+type cacheEntry struct {
+	Body []byte
+	ETag string
+
+	// Expires is when the entry stops being fresh, from the TTLs of the
+	// records in it.
+	Expires time.Time
+
+	// Resolved is when the records were resolved, which per-record maxAge
+	// values count from.
+	Resolved time.Time
+
+	// Signature is the X-Records-Signature header value, if signing is
+	// enabled.
+	Signature string
+
+	// NonAuthoritative is set if the response includes data that didn't
+	// come from DNS.
+	NonAuthoritative bool
+}
+
+// cacheBackend stores cache entries. A backend may fail, for example if it is
+// an external service that is down.
+type cacheBackend interface {
+	// get returns the entry stored under key, or nil if there is none.
+	get(key string) (*cacheEntry, error)
+	set(key string, entry *cacheEntry, ttl time.Duration) error
+}
+
+var (
+	cacheHits   = newCounter("xmppresolv_cache_hits_total", "Responses served from the cache.")
+	cacheMisses = newCounter("xmppresolv_cache_misses_total", "Responses that had to be resolved.")
+	cacheErrors = newCounter("xmppresolv_cache_errors_total", "Cache backend operations that failed.")
+)
+
+// cache wraps a backend so that it is only ever an optimization: backend
+// failures are logged and counted, and then treated as misses so that the
+// request is resolved directly. A nil *cache caches nothing.
+type cache struct {
+	backend cacheBackend
+}
+
+var responseCache *cache
+
+func (c *cache) get(key string) *cacheEntry {
+	if c == nil || key == "" {
+		return nil
+	}
+
+	entry, err := c.backend.get(key)
+	if err != nil {
+		cacheErrors.inc()
+		log.Printf("Error reading %q from cache: %v", key, err)
+		return nil
+	}
+
+	if entry == nil {
+		cacheMisses.inc()
+		return nil
+	}
+
+	cacheHits.inc()
+	return entry
+}
+
+func (c *cache) set(key string, entry *cacheEntry, ttl time.Duration) {
+	if c == nil || key == "" {
+		return
+	}
+
+	if err := c.backend.set(key, entry, ttl); err != nil {
+		cacheErrors.inc()
+		log.Printf("Error writing %q to cache: %v", key, err)
+	}
+}
+
+// cacheKey returns the key under which the response for domain with opts is
+// cached. Two requests must share a key only if their responses would be
+// byte-for-byte identical, so every option that changes the body is a
+// dimension of the key:
+//
+//	envelope, advice, meta, resolve, dnssec, validate, tlscheck, probe,
+//	type, scheme, rank, recommended, order, web, fallback, record-max-age,
+//	probe-subdomains, shuffle, profile, unicode, fields and the negotiated
+//	format.
+//
+// The enabled transports, search domains, conventional subdomains,
+// -filter-internal-addresses, -allow-targets and -capability-names are
+// included too, as a Redis cache may be shared by instances configured
+// differently. The domain is compared case-insensitively, as DNS is. The
+// etag option only decides between 200 and 304, and hints only changes error
+// responses, which aren't cached, so neither is a dimension; diagnostic
+// responses, such as those using the resolver option or order=rtt, are never
+// cached.
+//
+// Each dimension is written as name=value in a fixed order, with set-valued
+// options sorted, so the key doesn't depend on the order of parameters.
+func cacheKey(domain string, opts *options) string {
+	fields := make([]string, 0, len(opts.fields))
+	for name := range opts.fields {
+		fields = append(fields, name)
+	}
+	sort.Strings(fields)
+
+	transports := make([]string, len(enabledTransports))
+	for i, t := range enabledTransports {
+		transports[i] = t.name
+	}
+
+	dimensions := []string{
+		strings.ToLower(domain),
+		"envelope=" + strconv.FormatBool(opts.envelope),
+		"advice=" + strconv.FormatBool(opts.advice),
+		"meta=" + strconv.FormatBool(opts.meta),
+		"resolve=" + strconv.FormatBool(opts.resolve),
+		"dnssec-strict=" + strconv.FormatBool(opts.dnssecStrict),
+		"validate=" + strconv.FormatBool(opts.validate),
+		"tlscheck=" + strconv.FormatBool(opts.checkTLS),
+		"probe=" + strconv.FormatBool(opts.probe),
+		"type=" + opts.serviceType,
+		"scheme=" + strconv.FormatBool(opts.scheme),
+		"rank=" + strconv.FormatBool(opts.rank),
+		"recommended=" + strconv.FormatBool(opts.recommended),
+		"order=" + opts.order,
+		"web=" + strconv.FormatBool(opts.web),
+		"fallback=" + strconv.FormatBool(opts.fallback),
+		"record-max-age=" + strconv.FormatBool(opts.recordMaxAge),
+		"probe-subdomains=" + strconv.FormatBool(opts.probeSubdomains),
+		"shuffle=" + strconv.FormatBool(opts.shuffle),
+		"profile=" + opts.profile,
+		"unicode=" + strconv.FormatBool(opts.unicode),
+		"fields=" + strings.Join(fields, ","),
+		"format=" + opts.responseFormat().name,
+		"transports=" + strings.Join(transports, ","),
+		"search=" + strings.Join(searchDomains, ","),
+		"subdomains=" + strings.Join(conventionalSubdomains, ","),
+		"filter-internal=" + strconv.FormatBool(filterInternalAddresses),
+		"allow-targets=" + allowedTargets.String(),
+		"capabilities=" + strings.Join(capabilityNameList(), ","),
+	}
+
+	return strings.Join(dimensions, "|")
+}
+
+// newCacheEntry returns the entry for the encoded response with data,
+// fresh for as long as data's records are.
+func newCacheEntry(encoded []byte, data *responseData) *cacheEntry {
+	now := time.Now()
+	return &cacheEntry{
+		Body:             encoded,
+		ETag:             etagFor(encoded),
+		Expires:          now.Add(time.Duration(maxAgeFor(data.ttl)) * time.Second),
+		Resolved:         now,
+		Signature:        signRecords(data),
+		NonAuthoritative: data.NonAuthoritative,
+	}
+}
+
+// ttl returns how much longer e is fresh for.
+func (e *cacheEntry) ttl() time.Duration {
+	return time.Until(e.Expires)
+}
+
+type memoryItem struct {
+	key     string
+	entry   *cacheEntry
+	size    int64
+	expires time.Time
+}
+
+// memoryCache is an in-process LRU cache holding at most maxEntries entries
+// and, if maxBytes is not zero, at most maxBytes of keys and payloads, so
+// that a few huge responses can't dominate memory.
+type memoryCache struct {
+	mu         sync.Mutex
+	maxEntries int
+	maxBytes   int64
+	bytes      int64
+	lru        *list.List
+	items      map[string]*list.Element
+}
+
+func newMemoryCache(maxEntries int, maxBytes int64) *memoryCache {
+	return &memoryCache{
+		maxEntries: maxEntries,
+		maxBytes:   maxBytes,
+		lru:        list.New(),
+		items:      make(map[string]*list.Element),
+	}
+}
+
+func (c *memoryCache) get(key string) (*cacheEntry, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.items[key]
+	if !ok {
+		return nil, nil
+	}
+
+	item := el.Value.(*memoryItem)
+	if time.Now().After(item.expires) {
+		c.remove(el)
+		return nil, nil
+	}
+
+	c.lru.MoveToFront(el)
+	return item.entry, nil
+}
+
+func (c *memoryCache) set(key string, entry *cacheEntry, ttl time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[key]; ok {
+		c.remove(el)
+	}
+
+	// An entry that could never fit would only empty the cache.
+	size := int64(len(key) + len(entry.Body) + len(entry.ETag))
+	if c.maxBytes > 0 && size > c.maxBytes {
+		return nil
+	}
+
+	c.items[key] = c.lru.PushFront(&memoryItem{
+		key:     key,
+		entry:   entry,
+		size:    size,
+		expires: time.Now().Add(ttl),
+	})
+	c.bytes += size
+
+	for c.lru.Len() > c.maxEntries || (c.maxBytes > 0 && c.bytes > c.maxBytes) {
+		c.remove(c.lru.Back())
+	}
+
+	return nil
+}
+
+func (c *memoryCache) remove(el *list.Element) {
+	item := el.Value.(*memoryItem)
+
+	c.lru.Remove(el)
+	delete(c.items, item.key)
+	c.bytes -= item.size
+}
+
+// cacheStats describes the contents of a cache.
+type cacheStats struct {
+	Backend    string `json:"backend"`
+	Entries    int    `json:"entries"`
+	Bytes      int64  `json:"bytes"`
+	MaxEntries int    `json:"maxEntries"`
+	MaxBytes   int64  `json:"maxBytes,omitempty"`
+}
+
+func (c *memoryCache) stats() *cacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return &cacheStats{
+		Backend:    "memory",
+		Entries:    c.lru.Len(),
+		Bytes:      c.bytes,
+		MaxEntries: c.maxEntries,
+		MaxBytes:   c.maxBytes,
+	}
+}
+
+// memoryStats returns the stats of the in-memory cache, or nil if responses
+// aren't cached in memory.
+func memoryStats() *cacheStats {
+	if responseCache == nil {
+		return nil
+	}
+
+	if c, ok := responseCache.backend.(*memoryCache); ok {
+		return c.stats()
+	}
+
+	return nil
+}
+
+func init() {
+	newGauge("xmppresolv_cache_entries", "Responses held in the in-memory cache.", func() float64 {
+		if stats := memoryStats(); stats != nil {
+			return float64(stats.Entries)
+		}
+		return 0
+	})
+	newGauge("xmppresolv_cache_bytes", "Bytes of keys and responses held in the in-memory cache.", func() float64 {
+		if stats := memoryStats(); stats != nil {
+			return float64(stats.Bytes)
+		}
+		return 0
+	})
+}
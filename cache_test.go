@@ -0,0 +1,145 @@
+// Copyright 2015 Michael Johnson. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// keyFor returns the cache key of a request for domain with the raw query.
+func keyFor(t *testing.T, domain, rawQuery string) string {
+	t.Helper()
+
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts, err := parseOptions(query)
+	if err != nil {
+		t.Fatalf("%q: %v", rawQuery, err)
+	}
+
+	return cacheKey(domain, opts)
+}
+
+func TestCacheKeyDimensions(t *testing.T) {
+	queries := []string{
+		"",
+		"envelope=false",
+		"advice=true",
+		"meta=true",
+		"resolve=true",
+		"dnssec=strict",
+		"validate=true",
+		"validate=true&tlscheck=true",
+		"validate=true&probe=true",
+		"type=server",
+		"type=all",
+		"type=both",
+		"scheme=true",
+		"rank=true",
+		"recommended=true",
+		"order=rtt",
+		"web=true",
+		"fallback=true",
+		"record-max-age=true",
+		"probe-subdomains=true",
+		"shuffle=true",
+		"profile=mobile",
+		"unicode=true",
+		"fields=target",
+		"fields=target,port",
+		"format=msgpack",
+		"format=config&client=smack",
+	}
+
+	seen := make(map[string]string)
+	for _, query := range queries {
+		key := keyFor(t, "example.test", query)
+		if other, ok := seen[key]; ok {
+			t.Errorf("%q and %q share the key %q", query, other, key)
+		}
+		seen[key] = query
+	}
+}
+
+func TestCacheKeyCanonical(t *testing.T) {
+	tests := []struct {
+		domain, query           string
+		otherDomain, otherQuery string
+	}{
+		{"example.test", "resolve=true&validate=true", "example.test", "validate=true&resolve=true"},
+		{"example.test", "fields=target,port", "example.test", "fields=port,target"},
+		{"example.test", "", "Example.TEST", ""},
+		{"example.test", "", "example.test", "type=client&order=priority"},
+		{"example.test", "", "example.test", "format=json"},
+		{"example.test", "", "example.test", "etag=%22abc%22&hints=true"},
+	}
+
+	for _, tt := range tests {
+		if key, other := keyFor(t, tt.domain, tt.query), keyFor(t, tt.otherDomain, tt.otherQuery); key != other {
+			t.Errorf("%s?%s and %s?%s: keys %q and %q differ", tt.domain, tt.query, tt.otherDomain, tt.otherQuery, key, other)
+		}
+	}
+}
+
+func TestCacheKeyConfiguration(t *testing.T) {
+	useTransports(t, "tcp")
+	key := keyFor(t, "example.test", "")
+
+	useTransports(t, "tcp,tls")
+	if keyFor(t, "example.test", "") == key {
+		t.Error("enabling a transport left the key unchanged")
+	}
+}
+
+func TestMemoryCacheBytes(t *testing.T) {
+	// Each entry is 10 bytes: a one-byte key and a nine-byte body.
+	c := newMemoryCache(100, 30)
+	entry := &cacheEntry{Body: []byte("123456789")}
+
+	for _, key := range []string{"a", "b", "c"} {
+		c.set(key, entry, time.Minute)
+	}
+
+	// Using a makes b the least recently used, so d evicts it.
+	c.get("a")
+	c.set("d", entry, time.Minute)
+
+	for key, want := range map[string]bool{"a": true, "b": false, "c": true, "d": true} {
+		if got, _ := c.get(key); (got != nil) != want {
+			t.Errorf("%s cached = %t, want %t", key, got != nil, want)
+		}
+	}
+	if stats := c.stats(); stats.Entries != 3 || stats.Bytes != 30 {
+		t.Errorf("stats = %+v, want 3 entries of 30 bytes", stats)
+	}
+
+	// A bigger entry evicts as many as it needs to fit.
+	c.set("e", &cacheEntry{Body: []byte(strings.Repeat("x", 19))}, time.Minute)
+	if stats := c.stats(); stats.Entries != 2 || stats.Bytes != 30 {
+		t.Errorf("stats = %+v, want 2 entries of 30 bytes", stats)
+	}
+
+	// An entry that can never fit is left out rather than emptying the
+	// cache.
+	c.set("f", &cacheEntry{Body: []byte(strings.Repeat("x", 30))}, time.Minute)
+	if got, _ := c.get("f"); got != nil {
+		t.Error("an entry larger than the cache was cached")
+	}
+	if stats := c.stats(); stats.Entries != 2 || stats.Bytes != 30 {
+		t.Errorf("stats = %+v, want the 2 entries kept", stats)
+	}
+
+	// Replacing an entry counts only its new size.
+	c.set("e", entry, time.Minute)
+	if stats := c.stats(); stats.Entries != 2 || stats.Bytes != 20 {
+		t.Errorf("stats = %+v, want 2 entries of 20 bytes", stats)
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright 2015 Michael Johnson. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// capabilityNames are the attributes of _xmppconnect TXT records returned
+// as capabilities, by lowercase name, such as a minimum supported XMPP
+// version some operators publish. No standard defines them, so only the
+// names configured by -capability-names are returned, and anything else a
+// zone publishes in those records stays out of responses.
+var capabilityNames map[string]bool
+
+// capability is an attribute of the domain's _xmppconnect TXT records with one
+// of the capabilityNames.
+type capability struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// parseCapabilityNames parses a comma-separated list of capability names.
+// Names starting with _xmpp-client- are refused, as those attributes are
+// alternatives.
+func parseCapabilityNames(value string) (map[string]bool, error) {
+	names := make(map[string]bool)
+	for _, name := range strings.Split(value, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+
+		if strings.HasPrefix(name, "_xmpp-client-") || strings.Contains(name, "=") {
+			return nil, fmt.Errorf("invalid capability name %q", name)
+		}
+
+		names[name] = true
+	}
+
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	return names, nil
+}
+
+// capabilityNameList returns the capability names, sorted.
+func capabilityNameList() []string {
+	list := make([]string, 0, len(capabilityNames))
+	for name := range capabilityNames {
+		list = append(list, name)
+	}
+	sort.Strings(list)
+
+	return list
+}
+
+// parseCapabilities returns the capabilities in TXT records, sorted and
+// without duplicates, with their names in lowercase and their values as
+// published.
+func parseCapabilities(txt []string) []*capability {
+	var list []*capability
+	seen := make(map[capability]bool)
+	for _, rec := range txt {
+		name, value, ok := strings.Cut(rec, "=")
+		if name = strings.ToLower(name); !ok || !capabilityNames[name] {
+			continue
+		}
+
+		c := capability{name, value}
+		if !seen[c] {
+			seen[c] = true
+			list = append(list, &c)
+		}
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Name != list[j].Name {
+			return list[i].Name < list[j].Name
+		}
+		return list[i].Value < list[j].Value
+	})
+
+	return list
+}
@@ -0,0 +1,117 @@
+// Copyright 2015 Michael Johnson. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// configTemplate writes a connection config snippet for one client library
+// from the resolved records.
+type configTemplate func(buf *bytes.Buffer, domain string, data *responseData)
+
+// configTemplates are the client libraries format=config can write snippets
+// for, by the name given as the client parameter. Adding a library only
+// takes adding its template here.
+var configTemplates = map[string]configTemplate{
+	"smack":   smackConfig,
+	"strophe": stropheConfig,
+}
+
+// configFormats are the config snippet formats, one per template. They are
+// for people rather than programs, so they are kept out of formats and can't
+// be negotiated or made the default.
+var configFormats = func() map[string]*format {
+	m := make(map[string]*format, len(configTemplates))
+	for name, template := range configTemplates {
+		m[name] = &format{"config:" + name, "text/plain; charset=utf-8", configMarshaler(template)}
+	}
+
+	return m
+}()
+
+// configClients returns the names of the client libraries with templates.
+func configClients() []string {
+	names := make([]string, 0, len(configTemplates))
+	for name := range configTemplates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+func configMarshaler(template configTemplate) func(v interface{}) ([]byte, error) {
+	return func(v interface{}) ([]byte, error) {
+		data, ok := v.(*responseData)
+		if resp, isResp := v.(*response); isResp {
+			data, ok = resp.Data, resp.Data != nil
+		}
+
+		if !ok {
+			return nil, fmt.Errorf("cannot write a config snippet for %T", v)
+		}
+
+		var buf bytes.Buffer
+		template(&buf, strings.TrimSuffix(data.domain, "."), data)
+		return buf.Bytes(), nil
+	}
+}
+
+// smackConfig writes a Smack connection configuration for the most preferred
+// STARTTLS server. Smack connects over TCP, so alternatives don't apply.
+func smackConfig(buf *bytes.Buffer, domain string, data *responseData) {
+	fmt.Fprintf(buf, "// Smack connection configuration for %s.\n", domain)
+
+	var chosen *server
+	for _, s := range data.Servers.inPreferenceOrder() {
+		if t := s.via; t != nil && t.role == roleClient && t.proto == "tcp" && !t.directTLS && s.Port != 0 {
+			chosen = s
+			break
+		}
+	}
+
+	if chosen == nil {
+		fmt.Fprintf(buf, "// %s publishes no STARTTLS client server to connect to.\n", domain)
+		return
+	}
+
+	fmt.Fprintf(buf, "XMPPTCPConnectionConfiguration config = XMPPTCPConnectionConfiguration.builder()\n")
+	fmt.Fprintf(buf, "        .setXmppDomain(%s)\n", strconv.Quote(domain))
+	fmt.Fprintf(buf, "        .setHost(%s)\n", strconv.Quote(strings.TrimSuffix(chosen.Target, ".")))
+	fmt.Fprintf(buf, "        .setPort(%d)\n", chosen.Port)
+	fmt.Fprintf(buf, "        .setSecurityMode(ConnectionConfiguration.SecurityMode.required)\n")
+	fmt.Fprintf(buf, "        .build();\n")
+}
+
+// stropheConfig writes a Strophe.js connection to the domain's WebSocket
+// endpoint, or failing that its BOSH one. Strophe can't connect over TCP, so
+// servers don't apply.
+func stropheConfig(buf *bytes.Buffer, domain string, data *responseData) {
+	fmt.Fprintf(buf, "// Strophe.js connection for %s.\n", domain)
+
+	var urls []string
+	for _, name := range []string{"websocket", "xbosh"} {
+		for _, a := range data.Alternatives {
+			if a.Name == name && a.host() != "" {
+				urls = append(urls, a.Value)
+			}
+		}
+	}
+
+	if len(urls) == 0 {
+		fmt.Fprintf(buf, "// %s publishes no WebSocket or BOSH endpoint to connect to.\n", domain)
+		return
+	}
+
+	for _, url := range urls[1:] {
+		fmt.Fprintf(buf, "// Also published: %s\n", url)
+	}
+	fmt.Fprintf(buf, "const connection = new Strophe.Connection(%s);\n", strconv.Quote(urls[0]))
+}
@@ -0,0 +1,67 @@
+// Copyright 2015 Michael Johnson. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// corsAllowedHeaders are the request headers browsers may send cross-origin:
+// Authorization for admin access, and those for content negotiation and
+// conditional requests.
+var corsAllowedHeaders = []string{"Accept", "Authorization", "Content-Type", "If-None-Match"}
+
+// corsExposedHeaders are the response headers browsers let cross-origin
+// scripts read, besides those CORS always exposes. ETag lets web clients make
+// their own conditional requests, and Age tells them what per-record maxAge
+// values count from.
+var corsExposedHeaders = []string{"ETag", "Cache-Control", "Age"}
+
+// corsPreflightMaxAge is how long, in seconds, browsers may cache a preflight
+// response.
+const corsPreflightMaxAge = 86400
+
+// exposeHeader adds name to the corsExposedHeaders, unless it is already
+// there.
+func exposeHeader(name string) {
+	for _, exposed := range corsExposedHeaders {
+		if strings.EqualFold(exposed, name) {
+			return
+		}
+	}
+
+	corsExposedHeaders = append(corsExposedHeaders, name)
+}
+
+// allowCrossOrigin sets the CORS headers letting any origin read a response.
+func allowCrossOrigin(h http.Header) {
+	h.Set("Access-Control-Allow-Origin", "*")
+	if len(corsExposedHeaders) > 0 {
+		h.Set("Access-Control-Expose-Headers", strings.Join(corsExposedHeaders, ", "))
+	}
+}
+
+// servePreflight answers r if it is a CORS preflight request for a resource
+// accepting methods, reporting whether it did. Preflights are answered
+// before anything else is done for the request, so they never cause lookups.
+func servePreflight(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	if r.Method != "OPTIONS" {
+		return false
+	}
+
+	allowed := strings.Join(append(methods, "OPTIONS"), ", ")
+
+	h := w.Header()
+	h.Set("Allow", allowed)
+	h.Set("Access-Control-Allow-Origin", "*")
+	h.Set("Access-Control-Allow-Methods", allowed)
+	h.Set("Access-Control-Allow-Headers", strings.Join(corsAllowedHeaders, ", "))
+	h.Set("Access-Control-Max-Age", strconv.Itoa(corsPreflightMaxAge))
+	w.WriteHeader(http.StatusNoContent)
+
+	return true
+}
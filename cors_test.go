@@ -0,0 +1,61 @@
+// Copyright 2015 Michael Johnson. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPreflight(t *testing.T) {
+	s := useFixtures(t, srvFixture("_xmpp-client._tcp.example.com", 0, 0, 5222, "xmpp.example.com"))
+
+	tests := []struct {
+		path    string
+		handler http.HandlerFunc
+		methods string
+	}{
+		{"/example.com", serve, "GET, OPTIONS"},
+		{"/batch", serveBatch, "GET, HEAD, POST, OPTIONS"},
+		{"/rpc", serveRPC, "POST, OPTIONS"},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest("OPTIONS", tt.path, nil)
+		r.Header.Set("Origin", "https://app.example.net")
+		r.Header.Set("Access-Control-Request-Method", "GET")
+
+		w := httptest.NewRecorder()
+		tt.handler(w, r)
+
+		h := w.Header()
+		if w.Code != http.StatusNoContent || h.Get("Access-Control-Allow-Methods") != tt.methods || h.Get("Allow") != tt.methods {
+			t.Errorf("OPTIONS %s: status %d, headers %v; want 204 allowing %s", tt.path, w.Code, h, tt.methods)
+		}
+		if h.Get("Access-Control-Allow-Origin") != "*" || h.Get("Access-Control-Max-Age") != "86400" {
+			t.Errorf("OPTIONS %s: headers %v, want any origin for a day", tt.path, h)
+		}
+	}
+
+	if q := s.queried(); len(q) != 0 {
+		t.Errorf("queries = %v, want none for preflights", q)
+	}
+}
+
+func TestExposeHeader(t *testing.T) {
+	saved := corsExposedHeaders
+	corsExposedHeaders = []string{"ETag", "x-records-signature"}
+	defer func() { corsExposedHeaders = saved }()
+
+	exposeHeader(signatureHeader)
+	exposeHeader("Age")
+
+	h := make(http.Header)
+	allowCrossOrigin(h)
+	if got, want := h.Get("Access-Control-Expose-Headers"), "ETag, x-records-signature, Age"; got != want {
+		t.Errorf("Access-Control-Expose-Headers = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,918 @@
+// Copyright 2015 Michael Johnson. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/netip"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The standard library resolver only exposes the record data of a few record
+// types, and no TTLs. dnsClient speaks the wire protocol directly for the
+// lookups that need more than that.
+
+const (
+	dnsTypeSOA = 6
+	dnsTypeTXT = 16
+	dnsTypeSRV = 33
+	dnsTypeOPT = 41
+
+	dnsClassINET   = 1
+	dnsClassCHAOS  = 3
+	dnsClassHESIOD = 4
+
+	dnsRcodeSuccess  = 0
+	dnsRcodeServFail = 2
+	dnsRcodeNXDomain = 3
+	dnsRcodeRefused  = 5
+
+	// dnsUDPSize is the payload size advertised with EDNS(0).
+	dnsUDPSize = 4096
+)
+
+// dnsClasses are the classes that may be queried instead of IN, by mnemonic.
+var dnsClasses = map[string]uint16{
+	"IN": dnsClassINET,
+	"CH": dnsClassCHAOS,
+	"HS": dnsClassHESIOD,
+}
+
+var (
+	errDNSMalformed = errors.New("malformed DNS message")
+
+	// errDNSTruncated is returned when an answer was truncated even over
+	// TCP.
+	errDNSTruncated = errors.New("truncated DNS response")
+
+	// errNoNameservers is returned by clients without servers to query.
+	errNoNameservers = errors.New("no nameservers to send DNS queries to")
+)
+
+type dnsClient struct {
+	// servers are the host:port of the recursive resolvers queries are
+	// sent to, in the order they are tried. A client without any, as where
+	// there is no resolv.conf, can't make queries, and SRV and TXT lookups
+	// go to the standard library resolver instead.
+	servers []string
+
+	// timeout bounds each attempt at a query, and attempts is how many
+	// times each server is tried.
+	timeout  time.Duration
+	attempts int
+
+	// class is the class of the queries sent, or IN if zero.
+	class uint16
+}
+
+// configured reports whether the client has servers to send queries to.
+func (c *dnsClient) configured() bool {
+	return len(c.servers) > 0
+}
+
+func (c *dnsClient) queryClass() uint16 {
+	if c.class == 0 {
+		return dnsClassINET
+	}
+
+	return c.class
+}
+
+var wireClient = systemClient("/etc/resolv.conf")
+
+// systemClient returns a client for the nameservers in the resolv.conf file
+// name, with its timeout and attempts options. Without the file, as on
+// Windows, the client has no servers.
+func systemClient(name string) *dnsClient {
+	c := &dnsClient{timeout: 5 * time.Second, attempts: 2}
+
+	f, err := os.Open(name)
+	if err != nil {
+		return c
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+
+		switch fields[0] {
+		case "nameserver":
+			if _, err := netip.ParseAddr(fields[1]); err == nil {
+				c.servers = append(c.servers, net.JoinHostPort(fields[1], "53"))
+			}
+		case "options":
+			// As with glibc, timeout is in seconds and capped at 30,
+			// and attempts is capped at 5.
+			for _, option := range fields[1:] {
+				name, value, _ := strings.Cut(option, ":")
+				n, err := strconv.Atoi(value)
+				if err != nil || n < 1 {
+					continue
+				}
+
+				switch name {
+				case "timeout":
+					c.timeout = time.Duration(min(n, 30)) * time.Second
+				case "attempts":
+					c.attempts = min(n, 5)
+				}
+			}
+		}
+	}
+
+	return c
+}
+
+type dnsQuery struct {
+	name  string
+	qtype uint16
+	class uint16
+
+	// checkingDisabled asks a validating resolver to return data even if
+	// DNSSEC validation fails.
+	checkingDisabled bool
+}
+
+type dnsRR struct {
+	name  string
+	rtype uint16
+	class uint16
+	ttl   uint32
+
+	// msg is the whole message the record came from, which is needed to
+	// decompress names in the record data starting at off.
+	msg []byte
+	off int
+	len int
+}
+
+type dnsMsg struct {
+	id    uint16
+	rcode int
+
+	authoritative      bool
+	truncated          bool
+	recursionAvailable bool
+	authenticData      bool
+
+	answer    []*dnsRR
+	authority []*dnsRR
+}
+
+func appendName(b []byte, name string) ([]byte, error) {
+	name = strings.TrimSuffix(name, ".")
+	if len(name) > 253 {
+		return nil, fmt.Errorf("name %q is too long", name)
+	}
+
+	if name != "" {
+		for _, label := range strings.Split(name, ".") {
+			if len(label) == 0 || len(label) > 63 {
+				return nil, fmt.Errorf("name %q has an invalid label", name)
+			}
+
+			b = append(b, byte(len(label)))
+			b = append(b, label...)
+		}
+	}
+
+	return append(b, 0), nil
+}
+
+func (q *dnsQuery) pack(id uint16) ([]byte, error) {
+	flags := uint16(1 << 8) // RD
+	if q.checkingDisabled {
+		flags |= 1 << 4
+	}
+
+	b := make([]byte, 12, 512)
+	binary.BigEndian.PutUint16(b[0:], id)
+	binary.BigEndian.PutUint16(b[2:], flags)
+	binary.BigEndian.PutUint16(b[4:], 1)  // QDCOUNT
+	binary.BigEndian.PutUint16(b[10:], 1) // ARCOUNT
+
+	b, err := appendName(b, q.name)
+	if err != nil {
+		return nil, err
+	}
+
+	b = binary.BigEndian.AppendUint16(b, q.qtype)
+	b = binary.BigEndian.AppendUint16(b, q.class)
+
+	// EDNS(0) OPT pseudo-record.
+	b = append(b, 0)
+	b = binary.BigEndian.AppendUint16(b, dnsTypeOPT)
+	b = binary.BigEndian.AppendUint16(b, dnsUDPSize)
+	b = binary.BigEndian.AppendUint32(b, 0)
+	b = binary.BigEndian.AppendUint16(b, 0)
+
+	return b, nil
+}
+
+// readName decodes the possibly compressed name at off, returning it and the
+// offset just past it.
+func readName(msg []byte, off int) (string, int, error) {
+	var (
+		labels []string
+		end    = -1
+	)
+
+	for hops := 0; ; hops++ {
+		if off >= len(msg) || hops > 127 {
+			return "", 0, errDNSMalformed
+		}
+
+		l := int(msg[off])
+		switch {
+		case l == 0:
+			if end < 0 {
+				end = off + 1
+			}
+			return strings.Join(labels, ".") + ".", end, nil
+		case l&0xc0 == 0xc0:
+			if off+1 >= len(msg) {
+				return "", 0, errDNSMalformed
+			}
+			if end < 0 {
+				end = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3fff)
+		case l <= 63:
+			if off+1+l > len(msg) {
+				return "", 0, errDNSMalformed
+			}
+			labels = append(labels, string(msg[off+1:off+1+l]))
+			off += 1 + l
+		default:
+			return "", 0, errDNSMalformed
+		}
+	}
+}
+
+func readRR(msg []byte, off int) (*dnsRR, int, error) {
+	name, off, err := readName(msg, off)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if off+10 > len(msg) {
+		return nil, 0, errDNSMalformed
+	}
+
+	rr := &dnsRR{
+		name:  name,
+		rtype: binary.BigEndian.Uint16(msg[off:]),
+		class: binary.BigEndian.Uint16(msg[off+2:]),
+		ttl:   binary.BigEndian.Uint32(msg[off+4:]),
+		msg:   msg,
+		off:   off + 10,
+		len:   int(binary.BigEndian.Uint16(msg[off+8:])),
+	}
+
+	if rr.off+rr.len > len(msg) {
+		return nil, 0, errDNSMalformed
+	}
+
+	return rr, rr.off + rr.len, nil
+}
+
+func parseDNSMsg(msg []byte) (*dnsMsg, error) {
+	if len(msg) < 12 {
+		return nil, errDNSMalformed
+	}
+
+	flags := binary.BigEndian.Uint16(msg[2:])
+	m := &dnsMsg{
+		id:    binary.BigEndian.Uint16(msg),
+		rcode: int(flags & 0xf),
+
+		authoritative:      flags&(1<<10) != 0,
+		truncated:          flags&(1<<9) != 0,
+		recursionAvailable: flags&(1<<7) != 0,
+		authenticData:      flags&(1<<5) != 0,
+	}
+
+	if flags&(1<<15) == 0 {
+		return nil, errDNSMalformed
+	}
+
+	qdcount := int(binary.BigEndian.Uint16(msg[4:]))
+	ancount := int(binary.BigEndian.Uint16(msg[6:]))
+	nscount := int(binary.BigEndian.Uint16(msg[8:]))
+
+	off := 12
+	for i := 0; i < qdcount; i++ {
+		_, next, err := readName(msg, off)
+		if err != nil {
+			return nil, err
+		}
+		off = next + 4
+	}
+
+	for i := 0; i < ancount+nscount; i++ {
+		rr, next, err := readRR(msg, off)
+		if err != nil {
+			return nil, err
+		}
+		off = next
+
+		if i < ancount {
+			m.answer = append(m.answer, rr)
+		} else {
+			m.authority = append(m.authority, rr)
+		}
+	}
+
+	return m, nil
+}
+
+// dnsExchange is a query sent by the wire client and the header flags of the
+// reply, reported with debug=dns.
+type dnsExchange struct {
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+	Class string `json:"class,omitempty"`
+	Rcode string `json:"rcode,omitempty"`
+
+	// Protocol is udp, or tcp for the retry of a truncated reply.
+	Protocol string `json:"protocol"`
+
+	Authoritative      bool `json:"aa"`
+	Truncated          bool `json:"tc"`
+	RecursionAvailable bool `json:"ra"`
+	AuthenticData      bool `json:"ad"`
+	CheckingDisabled   bool `json:"cd,omitempty"`
+
+	// Error is why there was no reply.
+	Error string `json:"error,omitempty"`
+}
+
+// dnsTrace records every exchange the wire client makes for a request.
+type dnsTrace struct {
+	mu        sync.Mutex
+	exchanges []*dnsExchange
+}
+
+type dnsTraceKey struct{}
+
+// withDNSTrace returns a context in which the wire client records each of
+// its exchanges in t.
+func withDNSTrace(ctx context.Context, t *dnsTrace) context.Context {
+	return context.WithValue(ctx, dnsTraceKey{}, t)
+}
+
+func (t *dnsTrace) add(q *dnsQuery, network string, m *dnsMsg, err error) {
+	e := &dnsExchange{
+		Name:             q.name,
+		Type:             dnsTypeName(q.qtype),
+		Protocol:         network,
+		CheckingDisabled: q.checkingDisabled,
+	}
+
+	if q.class != dnsClassINET {
+		e.Class = dnsClassName(q.class)
+	}
+
+	if err != nil {
+		e.Error = err.Error()
+	} else {
+		e.Rcode = dnsRcodeName(m.rcode)
+		e.Authoritative = m.authoritative
+		e.Truncated = m.truncated
+		e.RecursionAvailable = m.recursionAvailable
+		e.AuthenticData = m.authenticData
+	}
+
+	t.record(e)
+}
+
+func (t *dnsTrace) record(e ...*dnsExchange) {
+	t.mu.Lock()
+	t.exchanges = append(t.exchanges, e...)
+	t.mu.Unlock()
+}
+
+// list returns the recorded exchanges by name and type, so that the order in
+// which concurrent lookups finished doesn't show.
+func (t *dnsTrace) list() []*dnsExchange {
+	t.mu.Lock()
+	out := append([]*dnsExchange(nil), t.exchanges...)
+	t.mu.Unlock()
+
+	sort.SliceStable(out, func(i, j int) bool {
+		if out[i].Name != out[j].Name {
+			return out[i].Name < out[j].Name
+		}
+
+		return out[i].Type < out[j].Type
+	})
+
+	return out
+}
+
+func dnsTypeName(qtype uint16) string {
+	switch qtype {
+	case dnsTypeSOA:
+		return "SOA"
+	case dnsTypeTXT:
+		return "TXT"
+	case dnsTypeSRV:
+		return "SRV"
+	}
+
+	return "TYPE" + strconv.Itoa(int(qtype))
+}
+
+func dnsClassName(class uint16) string {
+	for name, c := range dnsClasses {
+		if c == class {
+			return name
+		}
+	}
+
+	return "CLASS" + strconv.Itoa(int(class))
+}
+
+func dnsRcodeName(rcode int) string {
+	switch rcode {
+	case dnsRcodeSuccess:
+		return "NOERROR"
+	case dnsRcodeServFail:
+		return "SERVFAIL"
+	case dnsRcodeNXDomain:
+		return "NXDOMAIN"
+	case dnsRcodeRefused:
+		return "REFUSED"
+	}
+
+	return "RCODE" + strconv.Itoa(rcode)
+}
+
+// dnsFlight is an exchange in progress, which every identical query made
+// meanwhile waits for rather than sending its own.
+type dnsFlight struct {
+	done chan struct{}
+
+	m   *dnsMsg
+	err error
+
+	// exchanges are the attempts made, for the traces of every query
+	// sharing the flight.
+	exchanges []*dnsExchange
+}
+
+var (
+	flightsMu sync.Mutex
+	flights   = make(map[string]*dnsFlight)
+
+	dnsQueriesShared = newCounter("xmppresolv_dns_queries_shared_total", "DNS queries answered by an identical one already in flight.")
+)
+
+// exchange sends q to the client's servers and returns the reply, recording
+// each attempt in the context's trace, if there is one. Queries go over UDP
+// and are retried over TCP if the reply was truncated, as not every resolver
+// falls back to TCP itself and the partial answer would be taken for the
+// whole record set.
+//
+// Identical queries in flight at the same time share one exchange, whatever
+// the requests making them want done with the answer, so that concurrent
+// requests for a domain with different options only look it up once.
+func (c *dnsClient) exchange(ctx context.Context, q *dnsQuery) (*dnsMsg, error) {
+	if !c.configured() {
+		return nil, errNoNameservers
+	}
+
+	key := fmt.Sprintf("%s %s %d %d %t", strings.Join(c.servers, ","), strings.ToLower(q.name), q.qtype, q.class, q.checkingDisabled)
+
+	flightsMu.Lock()
+	f, shared := flights[key]
+	if !shared {
+		f = &dnsFlight{done: make(chan struct{})}
+		flights[key] = f
+		go c.fly(ctx, key, q, f)
+	}
+	flightsMu.Unlock()
+
+	if shared {
+		dnsQueriesShared.inc()
+	}
+
+	select {
+	case <-f.done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	if t, ok := ctx.Value(dnsTraceKey{}).(*dnsTrace); ok {
+		t.record(f.exchanges...)
+	}
+
+	return f.m, f.err
+}
+
+// fly makes the exchange for f. It isn't canceled with the request that
+// started it, as others may be waiting for it, but each attempt has the
+// client's timeout.
+func (c *dnsClient) fly(ctx context.Context, key string, q *dnsQuery, f *dnsFlight) {
+	defer func() {
+		flightsMu.Lock()
+		delete(flights, key)
+		flightsMu.Unlock()
+		close(f.done)
+	}()
+
+	trace := &dnsTrace{}
+	ctx = withDNSTrace(context.WithoutCancel(ctx), trace)
+
+	f.m, f.err = c.query(ctx, q)
+	f.exchanges = trace.exchanges
+}
+
+// query tries the servers in turn, as the standard library resolver does:
+// up to attempts times round all of them, moving on from any that times
+// out, can't be reached or answers SERVFAIL or REFUSED. If none answers
+// otherwise, the last reply or error is returned.
+func (c *dnsClient) query(ctx context.Context, q *dnsQuery) (m *dnsMsg, err error) {
+	for attempt := 0; attempt < max(c.attempts, 1); attempt++ {
+		for _, server := range c.servers {
+			m, err = c.attempt(ctx, server, q)
+			if err == nil && m.rcode != dnsRcodeServFail && m.rcode != dnsRcodeRefused {
+				return m, nil
+			}
+		}
+	}
+
+	return m, err
+}
+
+// attempt sends q to server, retrying over TCP if the reply was truncated,
+// within the client's timeout.
+func (c *dnsClient) attempt(ctx context.Context, server string, q *dnsQuery) (*dnsMsg, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	m, err := c.exchangeOver(ctx, "udp", server, q)
+	if err == nil && m.truncated {
+		m, err = c.exchangeOver(ctx, "tcp", server, q)
+	}
+
+	return m, err
+}
+
+func (c *dnsClient) exchangeOver(ctx context.Context, network, server string, q *dnsQuery) (m *dnsMsg, err error) {
+	if t, ok := ctx.Value(dnsTraceKey{}).(*dnsTrace); ok {
+		defer func() { t.add(q, network, m, err) }()
+	}
+
+	id := uint16(rand.Uint32())
+	query, err := q.pack(id)
+	if err != nil {
+		return nil, err
+	}
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if network == "tcp" {
+		return exchangeTCP(conn, query, id)
+	}
+
+	return exchangeUDP(conn, query, id)
+}
+
+// exchangeTCP sends query over the stream conn, prefixed by its length, and
+// reads the reply the same way.
+func exchangeTCP(conn net.Conn, query []byte, id uint16) (*dnsMsg, error) {
+	if _, err := conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(query))), query...)); err != nil {
+		return nil, err
+	}
+
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return nil, err
+	}
+
+	m, err := parseDNSMsg(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	if m.id != id {
+		return nil, errDNSMalformed
+	}
+
+	return m, nil
+}
+
+func exchangeUDP(conn net.Conn, query []byte, id uint16) (*dnsMsg, error) {
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, dnsUDPSize)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+
+		// Ignore anything that isn't a reply to this query, such as late
+		// or spoofed packets.
+		m, err := parseDNSMsg(buf[:n])
+		if err != nil || m.id != id {
+			continue
+		}
+
+		return m, nil
+	}
+}
+
+type soaRecord struct {
+	zone   string
+	serial uint32
+}
+
+func (rr *dnsRR) soa() (*soaRecord, error) {
+	// MNAME and RNAME precede the serial.
+	_, off, err := readName(rr.msg, rr.off)
+	if err != nil {
+		return nil, err
+	}
+
+	_, off, err = readName(rr.msg, off)
+	if err != nil {
+		return nil, err
+	}
+
+	if off+20 > rr.off+rr.len {
+		return nil, errDNSMalformed
+	}
+
+	return &soaRecord{
+		zone:   rr.name,
+		serial: binary.BigEndian.Uint32(rr.msg[off:]),
+	}, nil
+}
+
+// lookupSOA returns the SOA record of the zone containing name. The zone's
+// SOA is included in the authority section of negative answers, so this works
+// whether or not name is itself the zone apex.
+func (c *dnsClient) lookupSOA(ctx context.Context, name string) (*soaRecord, error) {
+	m, err := c.exchange(ctx, &dnsQuery{name: name, qtype: dnsTypeSOA, class: c.queryClass()})
+	if err != nil {
+		return nil, err
+	}
+
+	if m.rcode != dnsRcodeSuccess && m.rcode != dnsRcodeNXDomain {
+		return nil, fmt.Errorf("SOA lookup for %s failed with rcode %d", name, m.rcode)
+	}
+
+	for _, rr := range append(m.answer, m.authority...) {
+		if rr.rtype == dnsTypeSOA {
+			return rr.soa()
+		}
+	}
+
+	return nil, fmt.Errorf("no SOA record for %s", name)
+}
+
+// validationFailed reports whether a validating resolver rejects the records
+// for name as bogus. Such resolvers answer SERVFAIL, which is ambiguous on its
+// own, so the query is repeated with checking disabled: if that succeeds, the
+// failure was down to validation.
+func (c *dnsClient) validationFailed(ctx context.Context, name string, qtype uint16) (bool, error) {
+	q := &dnsQuery{name: name, qtype: qtype, class: c.queryClass()}
+
+	m, err := c.exchange(ctx, q)
+	if err != nil {
+		return false, err
+	}
+
+	if m.rcode != dnsRcodeServFail {
+		return false, nil
+	}
+
+	q.checkingDisabled = true
+
+	m, err = c.exchange(ctx, q)
+	if err != nil {
+		return false, err
+	}
+
+	return m.rcode == dnsRcodeSuccess || m.rcode == dnsRcodeNXDomain, nil
+}
+
+// dnsError returns the net.DNSError the standard library resolver would for
+// the same failure, so that callers can handle both alike.
+func (c *dnsClient) dnsError(name string, err error) *net.DNSError {
+	dnsErr := &net.DNSError{Err: err.Error(), Name: strings.TrimSuffix(name, ".")}
+	if c.configured() {
+		dnsErr.Server = c.servers[0]
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() || errors.Is(err, context.DeadlineExceeded) {
+		dnsErr.Err, dnsErr.IsTimeout = "i/o timeout", true
+	}
+
+	return dnsErr
+}
+
+// lookup returns the answer records of type qtype for name, in the same
+// cases and with the same kinds of error as the standard library resolver.
+func (c *dnsClient) lookup(ctx context.Context, name string, qtype uint16) ([]*dnsRR, error) {
+	m, err := c.exchange(ctx, &dnsQuery{name: name, qtype: qtype, class: c.queryClass()})
+	if err != nil {
+		return nil, c.dnsError(name, err)
+	}
+
+	if m.truncated {
+		return nil, c.dnsError(name, errDNSTruncated)
+	}
+
+	switch m.rcode {
+	case dnsRcodeSuccess:
+	case dnsRcodeNXDomain:
+		dnsErr := c.dnsError(name, errors.New("no such host"))
+		dnsErr.IsNotFound = true
+		return nil, dnsErr
+	case dnsRcodeServFail:
+		dnsErr := c.dnsError(name, errors.New("server misbehaving"))
+		dnsErr.IsTemporary = true
+		return nil, dnsErr
+	default:
+		return nil, c.dnsError(name, errors.New("server misbehaving"))
+	}
+
+	var records []*dnsRR
+	for _, rr := range m.answer {
+		if rr.rtype == qtype && rr.class == c.queryClass() {
+			records = append(records, rr)
+		}
+	}
+
+	if len(records) == 0 {
+		dnsErr := c.dnsError(name, errors.New("no such host"))
+		dnsErr.IsNotFound = true
+		return nil, dnsErr
+	}
+
+	return records, nil
+}
+
+// minTTL returns the smallest TTL of records.
+func minTTL(records []*dnsRR) uint32 {
+	ttl := records[0].ttl
+	for _, rr := range records[1:] {
+		ttl = min(ttl, rr.ttl)
+	}
+
+	return ttl
+}
+
+func (rr *dnsRR) srv() (*net.SRV, error) {
+	if rr.len < 7 {
+		return nil, errDNSMalformed
+	}
+
+	target, _, err := readName(rr.msg, rr.off+6)
+	if err != nil {
+		return nil, err
+	}
+
+	return &net.SRV{
+		Priority: binary.BigEndian.Uint16(rr.msg[rr.off:]),
+		Weight:   binary.BigEndian.Uint16(rr.msg[rr.off+2:]),
+		Port:     binary.BigEndian.Uint16(rr.msg[rr.off+4:]),
+		Target:   target,
+	}, nil
+}
+
+// txt returns the record's character-strings joined together, as the
+// standard library resolver does.
+func (rr *dnsRR) txt() (string, error) {
+	var b strings.Builder
+
+	for off, end := rr.off, rr.off+rr.len; off < end; {
+		l := int(rr.msg[off])
+		if off+1+l > end {
+			return "", errDNSMalformed
+		}
+
+		b.Write(rr.msg[off+1 : off+1+l])
+		off += 1 + l
+	}
+
+	return b.String(), nil
+}
+
+// lookupSRV returns the SRV records for name and their smallest TTL. As with
+// the standard library resolver, records whose target isn't a valid domain
+// name are left out and reported by an error returned with the rest.
+func (c *dnsClient) lookupSRV(ctx context.Context, name string) ([]*net.SRV, uint32, error) {
+	rrs, err := c.lookup(ctx, name, dnsTypeSRV)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var (
+		records []*net.SRV
+		invalid bool
+	)
+
+	for _, rr := range rrs {
+		srv, err := rr.srv()
+		if err != nil {
+			return nil, 0, c.dnsError(name, err)
+		}
+
+		if !isDomainName(srv.Target) {
+			invalid = true
+			continue
+		}
+
+		records = append(records, srv)
+	}
+
+	if invalid {
+		return records, minTTL(rrs), c.dnsError(name, errors.New("DNS response contained records which contain invalid names"))
+	}
+
+	return records, minTTL(rrs), nil
+}
+
+// lookupTXT returns the TXT records for name and their smallest TTL.
+func (c *dnsClient) lookupTXT(ctx context.Context, name string) ([]string, uint32, error) {
+	rrs, err := c.lookup(ctx, name, dnsTypeTXT)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	records := make([]string, len(rrs))
+	for i, rr := range rrs {
+		if records[i], err = rr.txt(); err != nil {
+			return nil, 0, c.dnsError(name, err)
+		}
+	}
+
+	return records, minTTL(rrs), nil
+}
+
+// isDomainName reports whether s is a valid hostname, allowing underscores
+// as the standard library resolver does. The root, ".", is valid.
+func isDomainName(s string) bool {
+	if s == "." {
+		return true
+	}
+
+	s = strings.TrimSuffix(s, ".")
+	if s == "" || len(s) > 253 {
+		return false
+	}
+
+	for _, label := range strings.Split(s, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+
+		for i := 0; i < len(label); i++ {
+			c := label[i]
+			if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-' || c == '_') {
+				return false
+			}
+		}
+	}
+
+	return true
+}
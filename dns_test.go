@@ -0,0 +1,160 @@
+// Copyright 2015 Michael Johnson. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSystemClient(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "resolv.conf")
+	conf := "# comment\nsearch example.com\nnameserver 192.0.2.1\nnameserver 2001:db8::1\nnameserver not-an-address\noptions ndots:2 timeout:3 attempts:9\n"
+	if err := os.WriteFile(name, []byte(conf), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	c := systemClient(name)
+	if want := []string{"192.0.2.1:53", "[2001:db8::1]:53"}; !reflect.DeepEqual(c.servers, want) {
+		t.Errorf("servers = %q, want %q", c.servers, want)
+	}
+	if c.timeout != 3*time.Second || c.attempts != 5 {
+		t.Errorf("timeout, attempts = %v, %d; want 3s, 5", c.timeout, c.attempts)
+	}
+
+	c = systemClient(filepath.Join(t.TempDir(), "missing"))
+	if c.configured() || c.timeout != 5*time.Second || c.attempts != 2 {
+		t.Errorf("without resolv.conf: %+v, want no servers and the defaults", c)
+	}
+}
+
+// silentServer returns the address of a UDP socket that never answers,
+// closed when the test ends.
+func silentServer(t *testing.T) string {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return conn.LocalAddr().String()
+}
+
+func TestDNSClientFailover(t *testing.T) {
+	s := newFixtureServer(t, srvFixture("_xmpp-client._tcp.example.test", 0, 0, 5222, "xmpp.example.test"))
+
+	c := &dnsClient{servers: []string{silentServer(t), s.addr}, timeout: 100 * time.Millisecond, attempts: 1}
+	records, _, err := c.lookupSRV(context.Background(), "_xmpp-client._tcp.example.test")
+	if err != nil || len(records) != 1 {
+		t.Errorf("lookupSRV = %v, %v; want the record from the second server", records, err)
+	}
+}
+
+func TestDNSClientAttempts(t *testing.T) {
+	var servers []string
+	for i := 0; i < 2; i++ {
+		servers = append(servers, silentServer(t))
+	}
+
+	c := &dnsClient{servers: servers, timeout: 50 * time.Millisecond, attempts: 2}
+
+	start := time.Now()
+	_, err := c.lookup(context.Background(), "attempts-"+strconv.Itoa(time.Now().Nanosecond())+".test", dnsTypeTXT)
+	elapsed := time.Since(start)
+
+	dnsErr, ok := err.(*net.DNSError)
+	if !ok || !dnsErr.IsTimeout {
+		t.Errorf("error = %v, want a timeout", err)
+	}
+
+	// Each of the two servers is tried twice.
+	if elapsed < 200*time.Millisecond {
+		t.Errorf("gave up after %v, want each server tried twice", elapsed)
+	}
+}
+
+func TestServeWithoutNameservers(t *testing.T) {
+	useFixtures(t, srvFixture("_xmpp-client._tcp.example.test", 0, 0, 5222, "xmpp.example.test"))
+	wireClient = &dnsClient{}
+
+	data := getData(t, "/example.test")
+	if len(data.Servers) != 1 {
+		t.Fatalf("servers = %+v, want the record from the standard library resolver", data.Servers)
+	}
+
+	// The TTL isn't known, so the default max-age applies.
+	w := get(t, "/example.test")
+	if got, want := w.Header().Get("Cache-Control"), "public, max-age="+strconv.Itoa(maxAgeFor(unknownTTL)); got != want {
+		t.Errorf("Cache-Control = %q, want %q", got, want)
+	}
+
+	if w := get(t, "/missing.test"); w.Code != 404 {
+		t.Errorf("missing domain: status %d, want 404", w.Code)
+	}
+}
+
+func TestDNSClientTruncated(t *testing.T) {
+	var fixtures []fixture
+	for i := 0; i < 30; i++ {
+		fixtures = append(fixtures, txtFixture("_xmppconnect.big.test", 60, fmt.Sprintf("_xmpp-client-websocket=wss://server-%02d.big.test/ws", i)))
+	}
+
+	s := newFixtureServer(t, fixtures...)
+	s.truncateUDP(512)
+
+	c := &dnsClient{servers: []string{s.addr}, timeout: time.Second, attempts: 1}
+	records, _, err := c.lookupTXT(context.Background(), "_xmppconnect.big.test")
+	if err != nil || len(records) != 30 {
+		t.Errorf("lookupTXT = %d records, %v; want all 30 over TCP", len(records), err)
+	}
+
+	if want := []string{"udp _xmppconnect.big.test.", "tcp _xmppconnect.big.test."}; !reflect.DeepEqual(s.queried(), want) {
+		t.Errorf("queries = %q, want %q", s.queried(), want)
+	}
+}
+
+func TestSharedLookups(t *testing.T) {
+	s := useFixtures(t,
+		srvFixture("_xmpp-client._tcp.example.test", 0, 0, 5222, "xmpp.example.test"),
+		txtFixture("_xmppconnect.example.test", 60, "_xmpp-client-websocket=wss://xmpp.example.test/ws"),
+	)
+
+	// The second request is made while the first one's queries are still
+	// in flight.
+	s.delayReplies(200 * time.Millisecond)
+
+	var wg sync.WaitGroup
+	codes := make([]int, 2)
+	for i, target := range []string{"/example.test", "/example.test?format=msgpack&fields=target,port"} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			codes[i] = get(t, target).Code
+		}()
+	}
+	wg.Wait()
+
+	if codes[0] != 200 || codes[1] != 200 {
+		t.Fatalf("statuses %v, want 200s", codes)
+	}
+
+	counts := make(map[string]int)
+	for _, q := range s.queried() {
+		counts[q]++
+	}
+	if want := map[string]int{"udp _xmpp-client._tcp.example.test.": 1, "udp _xmppconnect.example.test.": 1}; !reflect.DeepEqual(counts, want) {
+		t.Errorf("queries = %v, want each sent once for both requests", counts)
+	}
+}
@@ -0,0 +1,266 @@
+// Copyright 2015 Michael Johnson. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fixture is a record served by a fixtureServer, with its record data
+// already encoded.
+type fixture struct {
+	name  string
+	rtype uint16
+	ttl   uint32
+	data  []byte
+}
+
+func srvFixture(name string, priority, weight, port uint16, target string) fixture {
+	b := binary.BigEndian.AppendUint16(nil, priority)
+	b = binary.BigEndian.AppendUint16(b, weight)
+	b = binary.BigEndian.AppendUint16(b, port)
+	b, err := appendName(b, target)
+	if err != nil {
+		panic(err)
+	}
+
+	return fixture{name, dnsTypeSRV, 300, b}
+}
+
+// txtFixture returns a TXT record of the given character-strings.
+func txtFixture(name string, ttl uint32, strs ...string) fixture {
+	var b []byte
+	for _, s := range strs {
+		b = append(b, byte(len(s)))
+		b = append(b, s...)
+	}
+
+	return fixture{name, dnsTypeTXT, ttl, b}
+}
+
+func aFixture(name, ip string) fixture {
+	if v4 := net.ParseIP(ip).To4(); v4 != nil {
+		return fixture{name, 1, 60, v4}
+	}
+
+	return fixture{name, 28, 60, net.ParseIP(ip).To16()}
+}
+
+// fixtureServer is a DNS server on the loopback interface answering from
+// fixtures over UDP and TCP, like a recursive resolver would. Names with no
+// records of their own or below them don't exist.
+type fixtureServer struct {
+	addr     string
+	fixtures []fixture
+
+	mu      sync.Mutex
+	queries []string
+
+	// maxUDP, if set, truncates UDP replies longer than it.
+	maxUDP int
+
+	// delay holds up every reply, each on its own, by as long.
+	delay time.Duration
+
+	udp net.PacketConn
+	tcp net.Listener
+}
+
+// newFixtureServer starts a server for fixtures, which is stopped when the
+// test ends.
+func newFixtureServer(t *testing.T, fixtures ...fixture) *fixtureServer {
+	t.Helper()
+
+	s := &fixtureServer{fixtures: fixtures}
+
+	// The UDP port may already be taken for TCP, so a few are tried.
+	for i := 0; s.tcp == nil; i++ {
+		udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		tcp, err := net.Listen("tcp", udp.LocalAddr().String())
+		if err != nil {
+			udp.Close()
+			if i == 10 {
+				t.Fatal(err)
+			}
+			continue
+		}
+
+		s.addr, s.udp, s.tcp = udp.LocalAddr().String(), udp, tcp
+	}
+
+	go s.serveUDP()
+	go s.serveTCP()
+
+	t.Cleanup(func() {
+		s.udp.Close()
+		s.tcp.Close()
+	})
+
+	return s
+}
+
+func (s *fixtureServer) serveUDP() {
+	buf := make([]byte, 512)
+	for {
+		n, from, err := s.udp.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+
+		query := append([]byte(nil), buf[:n]...)
+		go func() {
+			if reply := s.answer(query, "udp"); reply != nil {
+				s.udp.WriteTo(reply, from)
+			}
+		}()
+	}
+}
+
+func (s *fixtureServer) serveTCP() {
+	for {
+		conn, err := s.tcp.Accept()
+		if err != nil {
+			return
+		}
+
+		go func() {
+			defer conn.Close()
+
+			for {
+				var length [2]byte
+				if _, err := io.ReadFull(conn, length[:]); err != nil {
+					return
+				}
+
+				query := make([]byte, binary.BigEndian.Uint16(length[:]))
+				if _, err := io.ReadFull(conn, query); err != nil {
+					return
+				}
+
+				reply := s.answer(query, "tcp")
+				conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(reply))), reply...))
+			}
+		}()
+	}
+}
+
+// answer returns the reply to query.
+func (s *fixtureServer) answer(query []byte, network string) []byte {
+	name, off, err := readName(query, 12)
+	if err != nil || off+4 > len(query) {
+		return nil
+	}
+
+	name = strings.ToLower(name)
+	qtype := binary.BigEndian.Uint16(query[off:])
+	qclass := binary.BigEndian.Uint16(query[off+2:])
+
+	s.mu.Lock()
+	s.queries = append(s.queries, network+" "+name)
+	maxUDP, delay := s.maxUDP, s.delay
+	s.mu.Unlock()
+
+	time.Sleep(delay)
+
+	var answer []fixture
+	exists := false
+	for _, f := range s.fixtures {
+		fname := strings.ToLower(strings.TrimSuffix(f.name, ".")) + "."
+		if fname == name {
+			exists = true
+			if f.rtype == qtype {
+				answer = append(answer, f)
+			}
+		} else if strings.HasSuffix(fname, "."+name) {
+			exists = true
+		}
+	}
+
+	// QR, RD and RA are set, and the question is copied.
+	flags := uint16(1<<15 | 1<<8 | 1<<7)
+	if !exists {
+		flags |= dnsRcodeNXDomain
+	}
+	if qclass != dnsClassINET {
+		answer, flags = nil, flags&^0xf|dnsRcodeRefused
+	}
+
+	b := make([]byte, 12, 512)
+	copy(b, query[:2])
+	binary.BigEndian.PutUint16(b[4:], 1)
+	b = append(b, query[12:off+4]...)
+
+	for _, f := range answer {
+		b, _ = appendName(b, f.name)
+		b = binary.BigEndian.AppendUint16(b, f.rtype)
+		b = binary.BigEndian.AppendUint16(b, dnsClassINET)
+		b = binary.BigEndian.AppendUint32(b, f.ttl)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(f.data)))
+		b = append(b, f.data...)
+	}
+	binary.BigEndian.PutUint16(b[6:], uint16(len(answer)))
+
+	if network == "udp" && maxUDP > 0 && len(b) > maxUDP {
+		b = b[:off+4]
+		binary.BigEndian.PutUint16(b[6:], 0)
+		flags |= 1 << 9
+	}
+	binary.BigEndian.PutUint16(b[2:], flags)
+
+	return b
+}
+
+// truncateUDP makes the server truncate UDP replies longer than n bytes.
+func (s *fixtureServer) truncateUDP(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.maxUDP = n
+}
+
+// delayReplies makes the server wait d before sending each reply.
+func (s *fixtureServer) delayReplies(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.delay = d
+}
+
+// queried returns the queries the server has received, as the network and
+// name of each.
+func (s *fixtureServer) queried() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]string(nil), s.queries...)
+}
+
+// useFixtures points every lookup at a server for fixtures until the test
+// ends, and returns the server.
+func useFixtures(t *testing.T, fixtures ...fixture) *fixtureServer {
+	t.Helper()
+
+	s := newFixtureServer(t, fixtures...)
+
+	savedResolver, savedClient := resolver, wireClient
+	resolver = newResolver(s.addr)
+	wireClient = &dnsClient{servers: []string{s.addr}, timeout: time.Second, attempts: 1}
+
+	t.Cleanup(func() {
+		resolver, wireClient = savedResolver, savedClient
+	})
+
+	return s
+}
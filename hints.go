@@ -0,0 +1,72 @@
+// Copyright 2015 Michael Johnson. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"time"
+)
+
+// hintsTimeout bounds the lookups made for hints=true, so that a 404 isn't
+// held up by them for longer than this.
+var hintsTimeout = time.Second
+
+// hint is a note in a 404 about what the domain has instead of XMPP records,
+// to help clients tell users why it can't be used.
+type hint struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// domainHints looks up whether domain, which has no XMPP records, resolves
+// and has MX records. The lookups are made together, under hintsTimeout,
+// and any that fail or don't finish in time are left out, as hints are only
+// ever a guess.
+func domainHints(ctx context.Context, domain string) []*hint {
+	ctx, cancel := context.WithTimeout(ctx, hintsTimeout)
+	defer cancel()
+
+	var (
+		mx    []*net.MX
+		mxErr error
+	)
+
+	g := newLookupGroup(ctx)
+	addrs := g.ip(domain)
+	g.run("MX "+domain, func(ctx context.Context) (err error) {
+		r, _ := resolversFor(ctx)
+		mx, err = r.LookupMX(ctx, domain)
+		return err
+	}, &mxErr)
+	g.wait()
+
+	var hints []*hint
+	if mxErr == nil && len(mx) > 0 && mx[0].Host != "." {
+		hints = append(hints, &hint{"mx", "The domain has MX records, so it may be used for email rather than XMPP."})
+	}
+
+	if addrs.err == nil && len(addrs.addrs) > 0 {
+		hints = append(hints, &hint{"addresses", "The domain has addresses, so it may host other services, such as a website."})
+	}
+
+	if len(hints) == 0 && isNotFound(addrs.err) && isNotFound(mxErr) {
+		hints = append(hints, &hint{"no-records", "The domain has no addresses or MX records either; check it is spelt correctly."})
+	}
+
+	return hints
+}
+
+// withHints returns the error response body with hints added.
+func withHints(body string, hints []*hint) string {
+	var resp response
+	if len(hints) == 0 || json.Unmarshal([]byte(body), &resp) != nil || resp.Error == nil {
+		return body
+	}
+
+	resp.Error.Hints = hints
+	return mustJSONEncode(&resp)
+}
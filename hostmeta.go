@@ -0,0 +1,156 @@
+// Copyright 2015 Michael Johnson. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// hostMetaTimeout bounds fetching a domain's host-meta document with
+// web=true, including any redirects.
+var hostMetaTimeout = 5 * time.Second
+
+// maxHostMetaSize caps how much of a host-meta document is read.
+const maxHostMetaSize = 64 << 10
+
+// sourceHostMeta marks alternatives found in a domain's host-meta document
+// (XEP-0156) rather than in DNS.
+const sourceHostMeta = "host-meta"
+
+// altConnectionsPrefix starts the link relation of each alternative
+// connection method in host-meta, followed by its name.
+const altConnectionsPrefix = "urn:xmpp:alt-connections:"
+
+var errNoHostMeta = errors.New("no host-meta document")
+
+type hostMetaLink struct {
+	Rel  string `json:"rel" xml:"rel,attr"`
+	Href string `json:"href" xml:"href,attr"`
+}
+
+type hostMetaLookup struct {
+	links []hostMetaLink
+	err   error
+}
+
+// hostMeta fetches the host-meta document of domain alongside the group's
+// DNS lookups, counting against the same limits but not the DNS query
+// budget.
+func (g *lookupGroup) hostMeta(domain string) *hostMetaLookup {
+	l := &hostMetaLookup{}
+	g.runLimited("host-meta "+domain, false, func(ctx context.Context) (err error) {
+		l.links, err = fetchHostMeta(ctx, domain)
+		return err
+	}, &l.err)
+
+	return l
+}
+
+// fetchHostMeta fetches the links in the host-meta document of domain,
+// preferring the JSON form and falling back to the XML one. It returns
+// errNoHostMeta if the domain has neither.
+func fetchHostMeta(ctx context.Context, domain string) ([]hostMetaLink, error) {
+	domain = strings.TrimSuffix(domain, ".")
+	if !isDomainName(domain) {
+		return nil, errNoHostMeta
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, hostMetaTimeout)
+	defer cancel()
+
+	r, _ := resolversFor(ctx)
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext:       outboundDialer(r).DialContext,
+			DisableKeepAlives: true,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 3 {
+				return errors.New("too many redirects")
+			}
+
+			return nil
+		},
+	}
+
+	links, err := getHostMeta(ctx, client, "https://"+domain+"/.well-known/host-meta.json", func(body []byte) ([]hostMetaLink, error) {
+		var doc struct {
+			Links []hostMetaLink `json:"links"`
+		}
+		err := json.Unmarshal(body, &doc)
+		return doc.Links, err
+	})
+	if err != errNoHostMeta {
+		return links, err
+	}
+
+	return getHostMeta(ctx, client, "https://"+domain+"/.well-known/host-meta", func(body []byte) ([]hostMetaLink, error) {
+		var doc struct {
+			Links []hostMetaLink `xml:"Link"`
+		}
+		err := xml.Unmarshal(body, &doc)
+		return doc.Links, err
+	})
+}
+
+func getHostMeta(ctx context.Context, client *http.Client, url string, parse func([]byte) ([]hostMetaLink, error)) ([]hostMetaLink, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+		return nil, errNoHostMeta
+	case resp.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxHostMetaSize+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(body) > maxHostMetaSize {
+		return nil, fmt.Errorf("document larger than %d bytes", maxHostMetaSize)
+	}
+
+	return parse(body)
+}
+
+// hostMetaAlternatives returns the alternative connection methods among links.
+func hostMetaAlternatives(links []hostMetaLink) []*alternative {
+	var alts []*alternative
+	for _, link := range links {
+		name, ok := strings.CutPrefix(link.Rel, altConnectionsPrefix)
+		if !ok || name == "" || link.Href == "" {
+			continue
+		}
+
+		alts = append(alts, &alternative{
+			Name:  name,
+			Value: canonicalURL(link.Href),
+
+			Source: sourceHostMeta,
+			ttl:    unknownTTL,
+		})
+	}
+
+	return alts
+}
@@ -0,0 +1,40 @@
+// Copyright 2015 Michael Johnson. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHostMetaConcurrent(t *testing.T) {
+	// The host-meta fetch looks up the domain's address, which fails to
+	// connect straight away.
+	s := useFixtures(t,
+		srvFixture("_xmpp-client._tcp.example.test", 0, 0, 5222, "xmpp.example.test"),
+		aFixture("example.test", "127.0.0.1"),
+	)
+
+	const delay = 300 * time.Millisecond
+	s.delayReplies(delay)
+
+	start := time.Now()
+	getData(t, "/example.test?web=true")
+	elapsed := time.Since(start)
+
+	// Made one after the other, the SRV and address lookups would take at
+	// least two delays.
+	if elapsed >= 2*delay-50*time.Millisecond {
+		t.Errorf("took %v, want the host-meta fetch alongside the DNS lookups", elapsed)
+	}
+
+	fetched := false
+	for _, q := range s.queried() {
+		fetched = fetched || q == "udp example.test."
+	}
+	if !fetched {
+		t.Errorf("queries = %v, want the host-meta host looked up", s.queried())
+	}
+}
@@ -0,0 +1,273 @@
+// Copyright 2015 Michael Johnson. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"math"
+	"strings"
+	"unicode/utf8"
+)
+
+// acePrefix marks a label as the ASCII Compatible Encoding of an
+// internationalized label (RFC 5890).
+const acePrefix = "xn--"
+
+// toUnicode returns the Unicode form of the hostname name, decoding each
+// label that has the ACE prefix. It returns "" if name has no such labels or
+// any of them is not valid Punycode, so that callers can omit the Unicode
+// form when it would only repeat name or be wrong.
+func toUnicode(name string) string {
+	labels := strings.Split(name, ".")
+
+	changed := false
+	for i, label := range labels {
+		if len(label) <= len(acePrefix) || !strings.EqualFold(label[:len(acePrefix)], acePrefix) {
+			continue
+		}
+
+		decoded, err := decodePunycode(strings.ToLower(label[len(acePrefix):]))
+		if err != nil {
+			return ""
+		}
+
+		labels[i] = decoded
+		changed = true
+	}
+
+	if !changed {
+		return ""
+	}
+
+	return strings.Join(labels, ".")
+}
+
+// toASCII returns the ASCII form of the hostname name, lowercasing it and
+// encoding each label that isn't ASCII with Punycode and the ACE prefix. Only
+// lowercasing is applied as mapping, so names needing more of UTS #46 are
+// encoded as given.
+func toASCII(name string) (string, error) {
+	labels := strings.Split(strings.ToLower(name), ".")
+
+	for i, label := range labels {
+		if isASCII(label) {
+			continue
+		}
+
+		if !utf8.ValidString(label) {
+			return "", errPunycode
+		}
+
+		encoded, err := encodePunycode(label)
+		if err != nil {
+			return "", err
+		}
+
+		labels[i] = acePrefix + encoded
+	}
+
+	return strings.Join(labels, "."), nil
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Punycode parameters, from RFC 3492 section 5.
+const (
+	punyBase        = 36
+	punyTMin        = 1
+	punyTMax        = 26
+	punySkew        = 38
+	punyDamp        = 700
+	punyInitialBias = 72
+	punyInitialN    = 128
+)
+
+var errPunycode = errors.New("invalid Punycode")
+
+// decodePunycode decodes s, a label without its ACE prefix, following the
+// decoding procedure in RFC 3492 section 6.2.
+func decodePunycode(s string) (string, error) {
+	var output []rune
+	if pos := strings.LastIndexByte(s, '-'); pos >= 0 {
+		for i := 0; i < pos; i++ {
+			if s[i] >= utf8.RuneSelf {
+				return "", errPunycode
+			}
+		}
+
+		output = []rune(s[:pos])
+		s = s[pos+1:]
+	}
+
+	n, bias, i := punyInitialN, punyInitialBias, 0
+	for len(s) > 0 {
+		oldi, w := i, 1
+		for k := punyBase; ; k += punyBase {
+			if len(s) == 0 {
+				return "", errPunycode
+			}
+
+			digit, ok := punyDigit(s[0])
+			s = s[1:]
+			if !ok || digit > (math.MaxInt32-i)/w {
+				return "", errPunycode
+			}
+			i += digit * w
+
+			t := k - bias
+			if t < punyTMin {
+				t = punyTMin
+			} else if t > punyTMax {
+				t = punyTMax
+			}
+
+			if digit < t {
+				break
+			}
+
+			if w > math.MaxInt32/(punyBase-t) {
+				return "", errPunycode
+			}
+			w *= punyBase - t
+		}
+
+		length := len(output) + 1
+		bias = punyAdapt(i-oldi, length, oldi == 0)
+
+		if i/length > math.MaxInt32-n {
+			return "", errPunycode
+		}
+		n += i / length
+		i %= length
+
+		if n < punyInitialN || n > utf8.MaxRune {
+			return "", errPunycode
+		}
+
+		output = append(output, 0)
+		copy(output[i+1:], output[i:])
+		output[i] = rune(n)
+		i++
+	}
+
+	return string(output), nil
+}
+
+// encodePunycode encodes the label s, following the encoding procedure in RFC
+// 3492 section 6.3. The ACE prefix is not added.
+func encodePunycode(s string) (string, error) {
+	input := []rune(s)
+
+	var output []byte
+	for _, r := range input {
+		if r < utf8.RuneSelf {
+			output = append(output, byte(r))
+		}
+	}
+
+	basic := len(output)
+	if basic > 0 {
+		output = append(output, '-')
+	}
+
+	n, delta, bias := punyInitialN, 0, punyInitialBias
+	for h := basic; h < len(input); {
+		m := math.MaxInt32
+		for _, r := range input {
+			if int(r) >= n && int(r) < m {
+				m = int(r)
+			}
+		}
+
+		if m-n > (math.MaxInt32-delta)/(h+1) {
+			return "", errPunycode
+		}
+		delta += (m - n) * (h + 1)
+		n = m
+
+		for _, r := range input {
+			if int(r) < n {
+				delta++
+			}
+
+			if int(r) != n {
+				continue
+			}
+
+			q := delta
+			for k := punyBase; ; k += punyBase {
+				t := k - bias
+				if t < punyTMin {
+					t = punyTMin
+				} else if t > punyTMax {
+					t = punyTMax
+				}
+
+				if q < t {
+					break
+				}
+
+				output = append(output, punyEncodeDigit(t+(q-t)%(punyBase-t)))
+				q = (q - t) / (punyBase - t)
+			}
+
+			output = append(output, punyEncodeDigit(q))
+			bias = punyAdapt(delta, h+1, h == basic)
+			delta = 0
+			h++
+		}
+
+		delta++
+		n++
+	}
+
+	return string(output), nil
+}
+
+func punyEncodeDigit(d int) byte {
+	if d < 26 {
+		return byte('a' + d)
+	}
+
+	return byte('0' + d - 26)
+}
+
+func punyDigit(c byte) (int, bool) {
+	switch {
+	case c >= 'a' && c <= 'z':
+		return int(c - 'a'), true
+	case c >= 'A' && c <= 'Z':
+		return int(c - 'A'), true
+	case c >= '0' && c <= '9':
+		return int(c-'0') + 26, true
+	}
+
+	return 0, false
+}
+
+func punyAdapt(delta, length int, first bool) int {
+	if first {
+		delta /= punyDamp
+	} else {
+		delta /= 2
+	}
+	delta += delta / length
+
+	k := 0
+	for delta > ((punyBase-punyTMin)*punyTMax)/2 {
+		delta /= punyBase - punyTMin
+		k += punyBase
+	}
+
+	return k + (punyBase-punyTMin+1)*delta/(delta+punySkew)
+}
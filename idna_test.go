@@ -0,0 +1,70 @@
+// Copyright 2015 Michael Johnson. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import "testing"
+
+// punycodeSamples are the sample strings of RFC 3492 section 7.1, with the
+// Hindi and Korean ones left out.
+var punycodeSamples = []struct {
+	unicode, encoded string
+}{
+	{"ليهمابتكلموشعربي؟", "egbpdaj6bu4bxfgehfvwxn"},
+	{"他们为什么不说中文", "ihqwcrb4cv8a8dqg056pqjye"},
+	{"他們爲什麽不說中文", "ihqwctvzc91f659drss3x8bo0yb"},
+	{"Pročprostěnemluvíčesky", "Proprostnemluvesky-uyb24dma41a"},
+	{"למההםפשוטלאמדבריםעברית", "4dbcagdahymbxekheh6e0a7fei0b"},
+	{"なぜみんな日本語を話してくれないのか", "n8jok5ay5dzabd5bym9f0cm5685rrjetr6pdxa"},
+	{"почемужеонинеговорятпорусски", "b1abfaaepdrnnbgefbadotcwatmq2g4l"},
+	{"PorquénopuedensimplementehablarenEspañol", "PorqunopuedensimplementehablarenEspaol-fmd56a"},
+	{"TạisaohọkhôngthểchỉnóitiếngViệt", "TisaohkhngthchnitingVit-kjcr8268qyxafd2f1b9g"},
+	{"3年B組金八先生", "3B-ww4c5e180e575a65lsy2b"},
+	{"安室奈美恵-with-SUPER-MONKEYS", "-with-SUPER-MONKEYS-pc58ag80a8qai00g7n9n"},
+	{"Hello-Another-Way-それぞれの場所", "Hello-Another-Way--fc4qua05auwb3674vfr0b"},
+	{"ひとつ屋根の下2", "2-u9tlzr9756bt3uc0v"},
+	{"MajiでKoiする5秒前", "MajiKoi5-783gue6qz075azm5e"},
+	{"パフィーdeルンバ", "de-jg4avhby1noc0d"},
+	{"そのスピードで", "d9juau41awczczp"},
+	{"-> $1.00 <-", "-> $1.00 <--"},
+}
+
+func TestPunycode(t *testing.T) {
+	for _, tt := range punycodeSamples {
+		if got, err := encodePunycode(tt.unicode); err != nil || got != tt.encoded {
+			t.Errorf("encodePunycode(%q) = %q, %v; want %q", tt.unicode, got, err, tt.encoded)
+		}
+
+		if got, err := decodePunycode(tt.encoded); err != nil || got != tt.unicode {
+			t.Errorf("decodePunycode(%q) = %q, %v; want %q", tt.encoded, got, err, tt.unicode)
+		}
+	}
+
+	for _, s := range []string{"a-é", "99999999999", "egbpdaj6bu4bxfgehfvwx!"} {
+		if got, err := decodePunycode(s); err == nil {
+			t.Errorf("decodePunycode(%q) = %q, want an error", s, got)
+		}
+	}
+}
+
+func TestHostnameForms(t *testing.T) {
+	if got, err := toASCII("Bücher.example"); err != nil || got != "xn--bcher-kva.example" {
+		t.Errorf("toASCII = %q, %v; want xn--bcher-kva.example", got, err)
+	}
+
+	tests := []struct {
+		name, want string
+	}{
+		{"xn--bcher-kva.example", "bücher.example"},
+		{"XN--BCHER-KVA.example", "bücher.example"},
+		{"example.test", ""},
+		{"xn--a!.example", ""},
+	}
+
+	for _, tt := range tests {
+		if got := toUnicode(tt.name); got != tt.want {
+			t.Errorf("toUnicode(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,455 @@
+// Copyright 2015 Michael Johnson. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// maxRequestLookups caps the number of DNS lookups a single request may
+	// have in flight at once. Further lookups queue until a slot frees up.
+	maxRequestLookups = 4
+
+	// lookupSlots caps the number of DNS lookups in flight across all
+	// requests. A nil channel means no global limit.
+	lookupSlots chan struct{}
+
+	// resolver is used for every lookup the standard library does, rather
+	// than those done with the wire client. It is always the pure Go
+	// resolver, as the cgo one reports errors and timeouts differently and
+	// needn't honor the lookup deadline. GODEBUG=netdns=cgo doesn't change
+	// this; GODEBUG=netdns=go+2 logs the resolver's decisions.
+	resolver = &net.Resolver{PreferGo: true}
+)
+
+type resolversKey struct{}
+
+type resolvers struct {
+	net  *net.Resolver
+	wire *dnsClient
+}
+
+// withResolver returns a context in which lookups go to the DNS server at addr
+// instead of the configured one.
+func withResolver(ctx context.Context, addr string) context.Context {
+	return context.WithValue(ctx, resolversKey{}, &resolvers{
+		net:  newResolver(addr),
+		wire: &dnsClient{servers: []string{addr}, timeout: wireClient.timeout, attempts: wireClient.attempts},
+	})
+}
+
+// withQueryClass returns a context in which the wire client sends queries of
+// the given class instead of IN.
+func withQueryClass(ctx context.Context, class uint16) context.Context {
+	r, c := resolversFor(ctx)
+	wire := *c
+	wire.class = class
+
+	return context.WithValue(ctx, resolversKey{}, &resolvers{net: r, wire: &wire})
+}
+
+func resolversFor(ctx context.Context) (*net.Resolver, *dnsClient) {
+	if r, ok := ctx.Value(resolversKey{}).(*resolvers); ok {
+		return r.net, r.wire
+	}
+
+	return resolver, wireClient
+}
+
+// newResolver returns a resolver that sends every query to the DNS server at
+// addr, rather than those configured on the system.
+func newResolver(addr string) *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+	}
+}
+
+type lookupTiming struct {
+	label    string
+	duration time.Duration
+}
+
+// lookupTimings records how long each lookup made for a request took.
+type lookupTimings struct {
+	mu      sync.Mutex
+	lookups []lookupTiming
+}
+
+type lookupTimingsKey struct{}
+
+// withLookupTimings returns a context in which every lookup records its
+// duration in t.
+func withLookupTimings(ctx context.Context, t *lookupTimings) context.Context {
+	return context.WithValue(ctx, lookupTimingsKey{}, t)
+}
+
+func (t *lookupTimings) add(label string, d time.Duration) {
+	t.mu.Lock()
+	t.lookups = append(t.lookups, lookupTiming{label, d})
+	t.mu.Unlock()
+}
+
+// slowest returns up to n lookups, slowest first.
+func (t *lookupTimings) slowest(n int) []lookupTiming {
+	t.mu.Lock()
+	out := append([]lookupTiming(nil), t.lookups...)
+	t.mu.Unlock()
+
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].duration > out[j].duration
+	})
+
+	if len(out) > n {
+		out = out[:n]
+	}
+
+	return out
+}
+
+// queryLimiter is a token bucket shared by every lookup, protecting the
+// upstream resolver from the service as a whole.
+type queryLimiter struct {
+	rate, burst float64
+
+	// maxWait is the longest a lookup may queue for a token before it
+	// fails with errQueryBudget.
+	maxWait time.Duration
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+var (
+	outboundLimiter *queryLimiter
+
+	errQueryBudget = errors.New("outbound DNS query budget exhausted")
+
+	dnsQueries         = newCounter("xmppresolv_dns_lookups_total", "DNS lookups attempted.")
+	dnsQueriesRejected = newCounter("xmppresolv_dns_lookups_rejected_total", "DNS lookups refused because the outbound query budget was exhausted.")
+	dnsQueryRate       = &rateMeter{}
+)
+
+func init() {
+	newGauge("xmppresolv_dns_lookups_per_second", "DNS lookups attempted in the last full second.", func() float64 {
+		return dnsQueryRate.rate(time.Now())
+	})
+}
+
+func newQueryLimiter(rate float64, maxWait time.Duration) *queryLimiter {
+	// Allow a second's worth of queries in a burst, so that a quiet
+	// service isn't made to queue the lookups of a single request.
+	burst := math.Max(rate, 1)
+
+	return &queryLimiter{
+		rate:    rate,
+		burst:   burst,
+		maxWait: maxWait,
+		tokens:  burst,
+		last:    time.Now(),
+	}
+}
+
+// reserve takes a token, possibly going into debt, and returns how long the
+// caller must wait before using it. If that would be longer than maxWait, no
+// token is taken and it returns false.
+func (l *queryLimiter) reserve(now time.Time) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	tokens := math.Min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+
+	var wait time.Duration
+	if tokens < 1 {
+		wait = time.Duration((1 - tokens) / l.rate * float64(time.Second))
+	}
+
+	if wait > l.maxWait {
+		return 0, false
+	}
+
+	l.tokens, l.last = tokens-1, now
+	return wait, true
+}
+
+func waitForQueryBudget(ctx context.Context) error {
+	now := time.Now()
+	dnsQueries.inc()
+	dnsQueryRate.mark(now)
+
+	if outboundLimiter == nil {
+		return nil
+	}
+
+	wait, ok := outboundLimiter.reserve(now)
+	if !ok {
+		dnsQueriesRejected.inc()
+		return errQueryBudget
+	}
+
+	if wait > 0 {
+		t := time.NewTimer(wait)
+		defer t.Stop()
+
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	return nil
+}
+
+// rateMeter counts events in whole seconds.
+type rateMeter struct {
+	mu                sync.Mutex
+	second            int64
+	current, previous int64
+}
+
+func (m *rateMeter) mark(now time.Time) {
+	m.mu.Lock()
+	m.advance(now.Unix())
+	m.current++
+	m.mu.Unlock()
+}
+
+// rate returns the number of events in the last full second.
+func (m *rateMeter) rate(now time.Time) float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.advance(now.Unix())
+	return float64(m.previous)
+}
+
+func (m *rateMeter) advance(second int64) {
+	switch {
+	case second == m.second:
+		return
+	case second == m.second+1:
+		m.previous = m.current
+	default:
+		m.previous = 0
+	}
+
+	m.second, m.current = second, 0
+}
+
+// lookupGroup runs the DNS lookups for a single request concurrently, subject
+// to both the per-request and global limits.
+type lookupGroup struct {
+	ctx   context.Context
+	slots chan struct{}
+	wg    sync.WaitGroup
+}
+
+func newLookupGroup(ctx context.Context) *lookupGroup {
+	g := &lookupGroup{ctx: ctx}
+	if maxRequestLookups > 0 {
+		g.slots = make(chan struct{}, maxRequestLookups)
+	}
+
+	return g
+}
+
+func (g *lookupGroup) acquire() error {
+	if g.slots != nil {
+		select {
+		case g.slots <- struct{}{}:
+		case <-g.ctx.Done():
+			return g.ctx.Err()
+		}
+	}
+
+	if lookupSlots != nil {
+		select {
+		case lookupSlots <- struct{}{}:
+		case <-g.ctx.Done():
+			if g.slots != nil {
+				<-g.slots
+			}
+			return g.ctx.Err()
+		}
+	}
+
+	return nil
+}
+
+func (g *lookupGroup) release() {
+	if lookupSlots != nil {
+		<-lookupSlots
+	}
+
+	if g.slots != nil {
+		<-g.slots
+	}
+}
+
+func (g *lookupGroup) run(label string, f func(ctx context.Context) error, errp *error) {
+	g.runLimited(label, true, f, errp)
+}
+
+// runLimited runs f like run, only waiting for the DNS query budget if
+// budgeted is set, for work in the group that isn't a DNS lookup.
+func (g *lookupGroup) runLimited(label string, budgeted bool, f func(ctx context.Context) error, errp *error) {
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+
+		if err := g.acquire(); err != nil {
+			*errp = err
+			return
+		}
+		defer g.release()
+
+		if budgeted {
+			if err := waitForQueryBudget(g.ctx); err != nil {
+				*errp = err
+				return
+			}
+		}
+
+		start := time.Now()
+		*errp = f(g.ctx)
+
+		if t, ok := g.ctx.Value(lookupTimingsKey{}).(*lookupTimings); ok {
+			t.add(label, time.Since(start))
+		}
+	}()
+}
+
+// wait blocks until every lookup started on the group has finished.
+func (g *lookupGroup) wait() {
+	g.wg.Wait()
+}
+
+// unknownTTL is the TTL of records whose TTL couldn't be found.
+const unknownTTL = -1
+
+// systemLookupError returns err from the standard library resolver with
+// Windows' answer for names that don't exist marked as not found, as older
+// versions of Go don't mark it themselves.
+func systemLookupError(err error) error {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && strings.HasSuffix(dnsErr.Err, "DNS name does not exist.") {
+		dnsErr.IsNotFound = true
+	}
+
+	return err
+}
+
+type srvLookup struct {
+	records []*net.SRV
+	ttl     int64
+	err     error
+}
+
+// srv looks up SRV records with the wire client, for their TTL, or where it
+// has no nameservers, with the standard library resolver, leaving the TTL
+// unknown.
+func (g *lookupGroup) srv(service, proto, name string) *srvLookup {
+	l := &srvLookup{ttl: unknownTTL}
+	g.run("SRV _"+service+"._"+proto+"."+name, func(ctx context.Context) (err error) {
+		r, c := resolversFor(ctx)
+		if !c.configured() {
+			_, l.records, err = r.LookupSRV(ctx, service, proto, name)
+			return systemLookupError(err)
+		}
+
+		var ttl uint32
+		l.records, ttl, err = c.lookupSRV(ctx, "_"+service+"._"+proto+"."+name)
+		l.ttl = int64(ttl)
+		return err
+	}, &l.err)
+
+	return l
+}
+
+type txtLookup struct {
+	records []string
+	ttl     int64
+	err     error
+}
+
+// txt looks up TXT records like srv.
+func (g *lookupGroup) txt(name string) *txtLookup {
+	l := &txtLookup{ttl: unknownTTL}
+	g.run("TXT "+name, func(ctx context.Context) (err error) {
+		r, c := resolversFor(ctx)
+		if !c.configured() {
+			l.records, err = r.LookupTXT(ctx, name)
+			return systemLookupError(err)
+		}
+
+		var ttl uint32
+		l.records, ttl, err = c.lookupTXT(ctx, name)
+		l.ttl = int64(ttl)
+		return err
+	}, &l.err)
+
+	return l
+}
+
+type soaLookup struct {
+	record *soaRecord
+	err    error
+}
+
+func (g *lookupGroup) soa(name string) *soaLookup {
+	l := &soaLookup{}
+	g.run("SOA "+name, func(ctx context.Context) (err error) {
+		_, c := resolversFor(ctx)
+		l.record, err = c.lookupSOA(ctx, name)
+		return err
+	}, &l.err)
+
+	return l
+}
+
+type ipLookup struct {
+	addrs []net.IPAddr
+	err   error
+}
+
+func (g *lookupGroup) ip(host string) *ipLookup {
+	l := &ipLookup{}
+	g.run("A/AAAA "+host, func(ctx context.Context) (err error) {
+		r, _ := resolversFor(ctx)
+		l.addrs, err = r.LookupIPAddr(ctx, host)
+		return err
+	}, &l.err)
+
+	return l
+}
+
+type dnssecCheck struct {
+	bogus bool
+	err   error
+}
+
+func (g *lookupGroup) dnssec(name string, qtype uint16) *dnssecCheck {
+	l := &dnssecCheck{}
+	g.run("DNSSEC "+name, func(ctx context.Context) (err error) {
+		_, c := resolversFor(ctx)
+		l.bogus, err = c.validationFailed(ctx, name, qtype)
+		return err
+	}, &l.err)
+
+	return l
+}
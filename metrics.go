@@ -0,0 +1,165 @@
+// Copyright 2015 Michael Johnson. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// metric is anything that can write itself in the Prometheus text exposition
+// format.
+type metric interface {
+	writeMetric(w io.Writer)
+}
+
+var (
+	metricsMu sync.Mutex
+	registry  []metric
+)
+
+func register(m metric) {
+	metricsMu.Lock()
+	registry = append(registry, m)
+	metricsMu.Unlock()
+}
+
+type counter struct {
+	name, help string
+	value      atomic.Int64
+}
+
+func newCounter(name, help string) *counter {
+	c := &counter{name: name, help: help}
+	register(c)
+	return c
+}
+
+func (c *counter) inc() {
+	c.value.Add(1)
+}
+
+func (c *counter) writeMetric(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", c.name, c.help, c.name, c.name, c.value.Load())
+}
+
+// gauge reports a value computed when the metrics are scraped.
+type gauge struct {
+	name, help string
+	value      func() float64
+}
+
+func newGauge(name, help string, value func() float64) *gauge {
+	g := &gauge{name: name, help: help, value: value}
+	register(g)
+	return g
+}
+
+func (g *gauge) writeMetric(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %g\n", g.name, g.help, g.name, g.name, g.value())
+}
+
+func serveMetrics(w http.ResponseWriter, r *http.Request) {
+	var buf bytes.Buffer
+
+	metricsMu.Lock()
+	for _, m := range registry {
+		m.writeMetric(&buf)
+	}
+	metricsMu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(buf.Bytes())
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// topCounter counts events per key, keeping individual counts only for the
+// most frequent n keys so that the number of label values stays bounded. It
+// uses the Space-Saving algorithm: when a new key arrives and all n slots are
+// taken, it replaces the least frequent key and inherits its count. Counts
+// for the top keys may therefore be overestimated, but any key more frequent
+// than 1/n of all events is guaranteed to be present.
+type topCounter struct {
+	name, help, label string
+	n                 int
+
+	mu     sync.Mutex
+	counts map[string]int64
+	total  int64
+}
+
+func newTopCounter(name, help, label string, n int) *topCounter {
+	c := &topCounter{
+		name:   name,
+		help:   help,
+		label:  label,
+		n:      n,
+		counts: make(map[string]int64, n),
+	}
+	register(c)
+	return c
+}
+
+func (c *topCounter) observe(key string) {
+	if c == nil || c.n <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.total++
+
+	if _, ok := c.counts[key]; ok || len(c.counts) < c.n {
+		c.counts[key]++
+		return
+	}
+
+	var (
+		minKey   string
+		minCount int64 = -1
+	)
+	for k, v := range c.counts {
+		if minCount < 0 || v < minCount {
+			minKey, minCount = k, v
+		}
+	}
+
+	delete(c.counts, minKey)
+	c.counts[key] = minCount + 1
+}
+
+func (c *topCounter) writeMetric(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+
+	keys := make([]string, 0, len(c.counts))
+	for k := range c.counts {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var listed int64
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s{%s=\"%s\"} %d\n", c.name, c.label, labelEscaper.Replace(k), c.counts[k])
+		listed += c.counts[k]
+	}
+
+	// The rest are counted in a metric of their own, as any label value
+	// could also be a key. Overestimates can make the listed keys add up
+	// to more than the total.
+	other := strings.TrimSuffix(c.name, "_total") + "_other_total"
+	fmt.Fprintf(w, "# HELP %s Events not counted under any of the keys of %s.\n# TYPE %s counter\n", other, c.name, other)
+	fmt.Fprintf(w, "%s %d\n", other, max(c.total-listed, 0))
+}
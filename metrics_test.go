@@ -0,0 +1,38 @@
+// Copyright 2015 Michael Johnson. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestTopCounterOther(t *testing.T) {
+	c := &topCounter{name: "test_requests_total", help: "Test.", label: "domain", n: 3, counts: make(map[string]int64)}
+	for _, key := range []string{"other", "other", "a.test", "a.test", "b.test"} {
+		c.observe(key)
+	}
+
+	var buf bytes.Buffer
+	c.writeMetric(&buf)
+
+	seen := make(map[string]bool)
+	for _, line := range strings.Split(buf.String(), "\n") {
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		series, _, _ := strings.Cut(line, " ")
+		if seen[series] {
+			t.Errorf("series %s is written twice in\n%s", series, buf.String())
+		}
+		seen[series] = true
+	}
+
+	if !seen[`test_requests_total{domain="other"}`] || !seen["test_requests_other_total"] {
+		t.Errorf("metrics are\n%s\nwant the domain other and the overflow apart", buf.String())
+	}
+}
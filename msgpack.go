@@ -0,0 +1,197 @@
+// Copyright 2015 Michael Johnson. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+)
+
+// marshalMsgpack encodes v as MessagePack. v is first marshalled as JSON, so
+// that the field names, omitted fields and custom marshallers are exactly
+// those of the JSON representation, and the result is then transcoded with
+// object keys kept in order.
+func marshalMsgpack(v interface{}) ([]byte, error) {
+	encoded, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(encoded))
+	dec.UseNumber()
+
+	value, err := decodeJSONValue(dec)
+	if err != nil {
+		return nil, err
+	}
+
+	return appendMsgpack(nil, value)
+}
+
+// msgpackValue is a decoded JSON value, with objects as ordered key/value
+// pairs since their length must be known before they are written.
+type msgpackValue struct {
+	scalar interface{}
+	array  []*msgpackValue
+	object []msgpackPair
+	kind   byte
+}
+
+type msgpackPair struct {
+	key   string
+	value *msgpackValue
+}
+
+const (
+	msgpackScalar = iota
+	msgpackArray
+	msgpackObject
+)
+
+func decodeJSONValue(dec *json.Decoder) (*msgpackValue, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	switch tok {
+	case json.Delim('['):
+		v := &msgpackValue{kind: msgpackArray, array: []*msgpackValue{}}
+		for dec.More() {
+			elem, err := decodeJSONValue(dec)
+			if err != nil {
+				return nil, err
+			}
+			v.array = append(v.array, elem)
+		}
+		_, err := dec.Token()
+		return v, err
+	case json.Delim('{'):
+		v := &msgpackValue{kind: msgpackObject}
+		for dec.More() {
+			key, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+
+			value, err := decodeJSONValue(dec)
+			if err != nil {
+				return nil, err
+			}
+
+			v.object = append(v.object, msgpackPair{key.(string), value})
+		}
+		_, err := dec.Token()
+		return v, err
+	default:
+		return &msgpackValue{scalar: tok}, nil
+	}
+}
+
+func appendMsgpack(b []byte, v *msgpackValue) ([]byte, error) {
+	var err error
+
+	switch v.kind {
+	case msgpackArray:
+		b = appendMsgpackHeader(b, len(v.array), 0x90, 0xdc, 0xdd)
+		for _, elem := range v.array {
+			if b, err = appendMsgpack(b, elem); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	case msgpackObject:
+		b = appendMsgpackHeader(b, len(v.object), 0x80, 0xde, 0xdf)
+		for _, pair := range v.object {
+			b = appendMsgpackString(b, pair.key)
+			if b, err = appendMsgpack(b, pair.value); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	}
+
+	switch s := v.scalar.(type) {
+	case nil:
+		return append(b, 0xc0), nil
+	case bool:
+		if s {
+			return append(b, 0xc3), nil
+		}
+		return append(b, 0xc2), nil
+	case string:
+		return appendMsgpackString(b, s), nil
+	case json.Number:
+		if i, err := s.Int64(); err == nil {
+			return appendMsgpackInt(b, i), nil
+		}
+
+		f, err := s.Float64()
+		if err != nil {
+			return nil, err
+		}
+
+		b = append(b, 0xcb)
+		return binary.BigEndian.AppendUint64(b, math.Float64bits(f)), nil
+	default:
+		return nil, fmt.Errorf("msgpack: unexpected JSON token %v", s)
+	}
+}
+
+// appendMsgpackHeader appends the header of an array or map of n elements,
+// given the type bytes of its fix, 16 and 32 bit forms.
+func appendMsgpackHeader(b []byte, n int, fix, b16, b32 byte) []byte {
+	switch {
+	case n < 16:
+		return append(b, fix|byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(b, b16), uint16(n))
+	default:
+		return binary.BigEndian.AppendUint32(append(b, b32), uint32(n))
+	}
+}
+
+func appendMsgpackString(b []byte, s string) []byte {
+	switch n := len(s); {
+	case n < 32:
+		b = append(b, 0xa0|byte(n))
+	case n <= math.MaxUint8:
+		b = append(b, 0xd9, byte(n))
+	case n <= math.MaxUint16:
+		b = binary.BigEndian.AppendUint16(append(b, 0xda), uint16(n))
+	default:
+		b = binary.BigEndian.AppendUint32(append(b, 0xdb), uint32(n))
+	}
+
+	return append(b, s...)
+}
+
+func appendMsgpackInt(b []byte, i int64) []byte {
+	switch {
+	case i >= 0 && i <= math.MaxInt8:
+		return append(b, byte(i))
+	case i >= -32 && i < 0:
+		return append(b, byte(i))
+	case i >= 0 && i <= math.MaxUint8:
+		return append(b, 0xcc, byte(i))
+	case i >= 0 && i <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(b, 0xcd), uint16(i))
+	case i >= 0 && i <= math.MaxUint32:
+		return binary.BigEndian.AppendUint32(append(b, 0xce), uint32(i))
+	case i >= 0:
+		return binary.BigEndian.AppendUint64(append(b, 0xcf), uint64(i))
+	case i >= math.MinInt8:
+		return append(b, 0xd0, byte(i))
+	case i >= math.MinInt16:
+		return binary.BigEndian.AppendUint16(append(b, 0xd1), uint16(i))
+	case i >= math.MinInt32:
+		return binary.BigEndian.AppendUint32(append(b, 0xd2), uint32(i))
+	default:
+		return binary.BigEndian.AppendUint64(append(b, 0xd3), uint64(i))
+	}
+}
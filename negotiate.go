@@ -0,0 +1,95 @@
+// Copyright 2015 Michael Johnson. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// acceptQuality returns the quality the Accept header value accept gives to
+// mediaType, taking the most specific matching range. It is 0 if the type
+// isn't acceptable.
+func acceptQuality(accept, mediaType string) float64 {
+	typ, _, _ := strings.Cut(mediaType, "/")
+
+	best, specificity := 0.0, -1
+	for _, part := range strings.Split(accept, ",") {
+		params := strings.Split(part, ";")
+		r := strings.ToLower(strings.TrimSpace(params[0]))
+
+		s := -1
+		switch r {
+		case mediaType:
+			s = 2
+		case typ + "/*":
+			s = 1
+		case "*/*":
+			s = 0
+		}
+
+		if s <= specificity {
+			continue
+		}
+
+		q := 1.0
+		for _, p := range params[1:] {
+			if v, ok := strings.CutPrefix(strings.TrimSpace(p), "q="); ok {
+				if f, err := strconv.ParseFloat(v, 64); err == nil {
+					q = f
+				}
+			}
+		}
+
+		best, specificity = q, s
+	}
+
+	return best
+}
+
+// format is a representation a response can be encoded in.
+type format struct {
+	name        string
+	contentType string
+	marshal     func(v interface{}) ([]byte, error)
+}
+
+var (
+	jsonFormat    = &format{"json", "application/json; charset=utf-8", json.Marshal}
+	msgpackFormat = &format{"msgpack", "application/msgpack", marshalMsgpack}
+)
+
+// formats are the formats by the names used for -default-format and the
+// format parameter.
+var formats = map[string]*format{
+	jsonFormat.name:    jsonFormat,
+	msgpackFormat.name: msgpackFormat,
+}
+
+// defaultFormat is the format used when the Accept header doesn't prefer one.
+var defaultFormat = jsonFormat
+
+// negotiateFormat returns the format the Accept header value accept prefers,
+// or defaultFormat if it doesn't prefer one over the other, as with */* or no
+// Accept header at all.
+func negotiateFormat(accept string) *format {
+	if accept == "" {
+		return defaultFormat
+	}
+
+	qJSON := acceptQuality(accept, "application/json")
+	qMsgpack := math.Max(acceptQuality(accept, "application/msgpack"), acceptQuality(accept, "application/x-msgpack"))
+
+	switch {
+	case qMsgpack > qJSON:
+		return msgpackFormat
+	case qJSON > qMsgpack:
+		return jsonFormat
+	default:
+		return defaultFormat
+	}
+}
@@ -0,0 +1,168 @@
+// Copyright 2015 Michael Johnson. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+)
+
+// domainPatterns is a set of domains, each matched exactly or, written as
+// *.example.com, any subdomain of example.com.
+type domainPatterns struct {
+	exact    map[string]bool
+	suffixes []string
+}
+
+var (
+	// allowedDomains, if not empty, are the only domains that may be
+	// resolved.
+	allowedDomains *domainPatterns
+
+	// deniedDomains may never be resolved, even if allowed.
+	deniedDomains *domainPatterns
+
+	// allowedTargets, if not empty, are the only server targets returned.
+	allowedTargets *domainPatterns
+)
+
+// parseDomainPatterns parses a comma-separated list of patterns, or if value
+// starts with @, the file named by the rest of it, with one pattern per line
+// and # starting a comment.
+func parseDomainPatterns(value string) (*domainPatterns, error) {
+	var patterns []string
+
+	if name, ok := strings.CutPrefix(value, "@"); ok {
+		f, err := os.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			line, _, _ := strings.Cut(scanner.Text(), "#")
+			patterns = append(patterns, line)
+		}
+
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	} else {
+		patterns = strings.Split(value, ",")
+	}
+
+	p := &domainPatterns{exact: make(map[string]bool)}
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(strings.Trim(strings.TrimSpace(pattern), "."))
+		if pattern == "" {
+			continue
+		}
+
+		if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+			if suffix == "" || strings.Contains(suffix, "*") {
+				return nil, fmt.Errorf("invalid pattern %q", pattern)
+			}
+
+			p.suffixes = append(p.suffixes, "."+suffix)
+			continue
+		}
+
+		if strings.Contains(pattern, "*") {
+			return nil, fmt.Errorf("invalid pattern %q: wildcards are only allowed as a leading *.", pattern)
+		}
+
+		p.exact[pattern] = true
+	}
+
+	if len(p.exact) == 0 && len(p.suffixes) == 0 {
+		return nil, nil
+	}
+
+	return p, nil
+}
+
+// match reports whether domain matches any of the patterns. A nil set
+// matches nothing.
+func (p *domainPatterns) match(domain string) bool {
+	if p == nil {
+		return false
+	}
+
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	if p.exact[domain] {
+		return true
+	}
+
+	for _, suffix := range p.suffixes {
+		if strings.HasSuffix(domain, suffix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// String returns the patterns in p, sorted and comma-separated, or "" if p is
+// nil.
+func (p *domainPatterns) String() string {
+	if p == nil {
+		return ""
+	}
+
+	patterns := make([]string, 0, len(p.exact)+len(p.suffixes))
+	for domain := range p.exact {
+		patterns = append(patterns, domain)
+	}
+
+	for _, suffix := range p.suffixes {
+		patterns = append(patterns, "*"+suffix)
+	}
+	sort.Strings(patterns)
+
+	return strings.Join(patterns, ",")
+}
+
+// permittedTargets returns the servers whose targets -allow-targets permits,
+// and how many were left out, logging each.
+//
+// A resolver whose answers have been poisoned, or a zone that has been
+// hijacked, can point clients at servers run by an attacker, who then only
+// needs a certificate for the domain to impersonate it, or none if a client
+// accepts the wrong one. Operators who know where their users' servers are
+// hosted can rule out every other target, so that such answers are dropped
+// rather than served with the service's authority. It doesn't help against
+// an attacker who can put records under a permitted suffix.
+func permittedTargets(domain string, servers serverList) (serverList, int) {
+	if allowedTargets == nil {
+		return servers, 0
+	}
+
+	permitted := servers[:0]
+	for _, s := range servers {
+		if allowedTargets.match(s.Target) {
+			permitted = append(permitted, s)
+			continue
+		}
+
+		log.Printf("WARN leaving out server %s for %q, which -allow-targets doesn't permit", s.Target, domain)
+	}
+
+	return permitted, len(servers) - len(permitted)
+}
+
+// domainPermitted reports whether the -allow-domains and -deny-domains
+// policy lets domain be resolved.
+func domainPermitted(domain string) bool {
+	if deniedDomains.match(domain) {
+		return false
+	}
+
+	return allowedDomains == nil || allowedDomains.match(domain)
+}
@@ -0,0 +1,174 @@
+// Copyright 2015 Michael Johnson. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ready is set once the service should receive traffic, which is when any
+// resolver warmup and prewarming it waits for have finished.
+var ready atomic.Bool
+
+// warmupZones are looked up by -warmup. Every resolver can answer for them,
+// and looking them up primes its cache with the delegations most lookups
+// pass through.
+var warmupZones = []string{"com.", "net.", "org."}
+
+// warmUpResolvers makes a few throwaway lookups with both the wire client and
+// the standard library resolver, so that the first requests don't pay for
+// cold connections and caches upstream. Failures are only logged, as the
+// service can still serve without the warmup.
+func warmUpResolvers(timeout time.Duration) {
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	start := time.Now()
+	g := newLookupGroup(ctx)
+
+	var (
+		soas = make([]*soaLookup, len(warmupZones))
+		errs = make([]error, len(warmupZones))
+	)
+
+	for i, zone := range warmupZones {
+		soas[i] = g.soa(zone)
+		g.run("NS "+zone, func(ctx context.Context) error {
+			r, _ := resolversFor(ctx)
+			_, err := r.LookupNS(ctx, zone)
+			return err
+		}, &errs[i])
+	}
+
+	g.wait()
+
+	failed := 0
+	for i, zone := range warmupZones {
+		for _, err := range []error{soas[i].err, errs[i]} {
+			if err != nil {
+				log.Printf("WARN warmup lookup for %s failed: %v", zone, err)
+				failed++
+			}
+		}
+	}
+
+	log.Printf("Warmed up the resolvers in %v, %d of %d lookups failed", time.Since(start).Round(time.Millisecond), failed, 2*len(warmupZones))
+}
+
+// readPrewarmFile returns the domains listed in the file name, one per line,
+// with # starting a comment.
+func readPrewarmFile(name string) ([]string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var domains []string
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		if line = strings.TrimSpace(line); line != "" {
+			domains = append(domains, line)
+		}
+	}
+
+	return domains, scanner.Err()
+}
+
+// prewarm resolves each domain with the default options so that their
+// responses are cached, giving up after timeout if it is not zero.
+func prewarm(domains []string, timeout time.Duration) {
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	opts, err := parseOptions(url.Values{})
+	if err != nil {
+		panic(err)
+	}
+
+	// Prewarmed responses are those of requests without an Accept header.
+	opts.format = defaultFormat
+
+	var (
+		start  = time.Now()
+		done   atomic.Int64
+		failed atomic.Int64
+		slots  = make(chan struct{}, batchConcurrency)
+		wg     sync.WaitGroup
+	)
+
+	log.Printf("Prewarming the cache with %d domains", len(domains))
+
+	for _, domain := range domains {
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+		}
+
+		if ctx.Err() != nil {
+			break
+		}
+
+		wg.Add(1)
+		go func(domain string) {
+			defer wg.Done()
+			defer func() { <-slots }()
+
+			// A missing domain has simply nothing to cache, as errors
+			// never are, so only real failures count.
+			if _, _, rerr := cachedResponse(ctx, domain, opts); rerr != nil && rerr.code != http.StatusNotFound {
+				failed.Add(1)
+			}
+
+			if n := done.Add(1); n%100 == 0 {
+				log.Printf("Prewarmed %d of %d domains", n, len(domains))
+			}
+		}(domain)
+	}
+
+	wg.Wait()
+
+	if ctx.Err() != nil {
+		log.Printf("WARN prewarming timed out after %v with %d of %d domains done", time.Since(start).Round(time.Millisecond), done.Load(), len(domains))
+		return
+	}
+
+	log.Printf("Prewarmed %d domains in %v, %d failed", len(domains), time.Since(start).Round(time.Millisecond), failed.Load())
+}
+
+// serveReady reports whether the service is ready for traffic, for load
+// balancer health checks.
+func serveReady(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+
+	if !ready.Load() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, "warming up")
+		return
+	}
+
+	fmt.Fprintln(w, "ok")
+}
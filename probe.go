@@ -0,0 +1,207 @@
+// Copyright 2015 Michael Johnson. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// probeTimeout bounds each XMPP stream probe, from connecting to reading the
+// stream features.
+var probeTimeout = 5 * time.Second
+
+// maxProbeRead caps how much a probed server may send before its stream
+// features are complete.
+const maxProbeRead = 64 << 10
+
+const (
+	nsStream = "http://etherx.jabber.org/streams"
+	nsTLS    = "urn:ietf:params:xml:ns:xmpp-tls"
+	nsCaps   = "http://jabber.org/protocol/caps"
+)
+
+// streamInfo is what a probe learnt from a server's stream header and
+// features.
+type streamInfo struct {
+	version         string
+	startTLS        bool
+	startTLSRequire bool
+	capsNode        string
+}
+
+// probeServers opens an XMPP stream to each TCP server in data and adds
+// findings about what it offers: whether STARTTLS is, and the software
+// advertised through entity capabilities (XEP-0115), if any. Direct TLS
+// servers are probed over TLS without verifying the certificate, which is
+// left to tlscheck.
+func probeServers(ctx context.Context, domain string, data *responseData) {
+	domain = strings.TrimSuffix(domain, ".")
+	r, _ := resolversFor(ctx)
+
+	var servers serverList
+	for _, s := range data.allServers() {
+		if t := s.via; t != nil && t.proto == "tcp" && s.Port != 0 {
+			servers = append(servers, s)
+		}
+	}
+
+	data.addFindingsConcurrently(servers, func(s *server) []*finding {
+		endpoint := net.JoinHostPort(strings.TrimSuffix(s.Target, "."), strconv.Itoa(int(s.Port)))
+
+		info, err := probeStream(ctx, r, domain, endpoint, s.via)
+		if err != nil {
+			return []*finding{{severityWarning, endpoint, fmt.Sprintf("The XMPP stream could not be opened: %v.", err)}}
+		}
+
+		var findings []*finding
+		switch {
+		case s.via.directTLS:
+		case info.startTLSRequire:
+			findings = append(findings, &finding{severityInfo, endpoint, "The server requires STARTTLS."})
+		case info.startTLS:
+			findings = append(findings, &finding{severityWarning, endpoint, "The server offers STARTTLS but does not require it."})
+		default:
+			findings = append(findings, &finding{severityWarning, endpoint, "The server does not offer STARTTLS."})
+		}
+
+		if info.version != "1.0" {
+			findings = append(findings, &finding{severityWarning, endpoint, fmt.Sprintf("The server uses stream version %q rather than 1.0.", info.version)})
+		}
+
+		if info.capsNode != "" {
+			findings = append(findings, &finding{severityInfo, endpoint, fmt.Sprintf("The server identifies its software as %s.", info.capsNode)})
+		}
+
+		return findings
+	})
+}
+
+// probeStream connects to endpoint, opens a stream to domain and reads the
+// stream features.
+func probeStream(ctx context.Context, r *net.Resolver, domain, endpoint string, t *transport) (*streamInfo, error) {
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+
+	d := outboundDialer(r)
+
+	var (
+		conn net.Conn
+		err  error
+	)
+	if t.directTLS {
+		conn, err = (&tls.Dialer{
+			NetDialer: d,
+			Config: &tls.Config{
+				ServerName:         domain,
+				NextProtos:         []string{"xmpp-" + t.role},
+				InsecureSkipVerify: true,
+			},
+		}).DialContext(ctx, "tcp", endpoint)
+	} else {
+		conn, err = d.DialContext(ctx, "tcp", endpoint)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+
+	header := fmt.Sprintf("<?xml version='1.0'?><stream:stream to='%s' version='1.0' xmlns='jabber:%s' xmlns:stream='%s'>", xmlEscape(domain), t.role, nsStream)
+	if _, err := io.WriteString(conn, header); err != nil {
+		return nil, err
+	}
+
+	return readStreamFeatures(xml.NewDecoder(io.LimitReader(conn, maxProbeRead)))
+}
+
+// readStreamFeatures reads the stream header and the features that follow.
+func readStreamFeatures(dec *xml.Decoder) (*streamInfo, error) {
+	info := &streamInfo{}
+	depth := 0
+	inFeatures, inStartTLS := false, false
+
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			return nil, fmt.Errorf("the server closed the stream before sending its features")
+		} else if err != nil {
+			return nil, err
+		}
+
+		switch tok := tok.(type) {
+		case xml.StartElement:
+			depth++
+
+			switch {
+			case depth == 1:
+				if tok.Name.Space != nsStream || tok.Name.Local != "stream" {
+					return nil, fmt.Errorf("unexpected <%s> element instead of a stream", tok.Name.Local)
+				}
+
+				for _, attr := range tok.Attr {
+					if attr.Name.Space == "" && attr.Name.Local == "version" {
+						info.version = attr.Value
+					}
+				}
+			case depth == 2 && tok.Name.Space == nsStream && tok.Name.Local == "error":
+				return nil, fmt.Errorf("the server returned a stream error: %s", streamErrorCondition(dec))
+			case depth == 2 && tok.Name.Space == nsStream && tok.Name.Local == "features":
+				inFeatures = true
+			case depth == 3 && inFeatures && tok.Name.Space == nsTLS && tok.Name.Local == "starttls":
+				info.startTLS, inStartTLS = true, true
+			case depth == 4 && inStartTLS && tok.Name.Local == "required":
+				info.startTLSRequire = true
+			case depth == 3 && inFeatures && tok.Name.Space == nsCaps && tok.Name.Local == "c":
+				for _, attr := range tok.Attr {
+					if attr.Name.Local == "node" {
+						info.capsNode = attr.Value
+					}
+				}
+			}
+		case xml.EndElement:
+			depth--
+
+			switch {
+			case depth == 0:
+				return nil, fmt.Errorf("the server closed the stream before sending its features")
+			case depth == 1 && inFeatures:
+				return info, nil
+			case depth == 2:
+				inStartTLS = false
+			}
+		}
+	}
+}
+
+// streamErrorCondition returns the name of the condition of the stream
+// error being read from dec.
+func streamErrorCondition(dec *xml.Decoder) string {
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return "unknown"
+		}
+
+		if start, ok := tok.(xml.StartElement); ok {
+			return start.Name.Local
+		}
+	}
+}
+
+func xmlEscape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
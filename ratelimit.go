@@ -0,0 +1,430 @@
+// Copyright 2015 Michael Johnson. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// trustedProxies are the networks whose X-Forwarded-For headers are believed
+// when identifying clients.
+var trustedProxies []*net.IPNet
+
+func parseNetworks(list string) ([]*net.IPNet, error) {
+	var out []*net.IPNet
+
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+
+		if !strings.Contains(s, "/") {
+			if ip := net.ParseIP(s); ip != nil && ip.To4() != nil {
+				s += "/32"
+			} else {
+				s += "/128"
+			}
+		}
+
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+
+		out = append(out, n)
+	}
+
+	return out, nil
+}
+
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, n := range networks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// clientIP returns the address of the client that made r. X-Forwarded-For is
+// walked from the right, skipping trusted proxies, so that a client cannot
+// pick its own address by sending the header itself.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil || !containsIP(trustedProxies, ip) {
+		return host
+	}
+
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		ip := net.ParseIP(hop)
+		if ip == nil {
+			break
+		}
+
+		host = hop
+		if !containsIP(trustedProxies, ip) {
+			break
+		}
+	}
+
+	return host
+}
+
+// tokenBucket holds up to burst tokens and refills at rate tokens per second.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter rate limits requests with a token bucket per key.
+type rateLimiter struct {
+	rate  float64
+	burst float64
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	return &rateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// take removes a token from the bucket for key. If the bucket is empty it
+// returns false and the time until a token will be available.
+func (l *rateLimiter) take(key string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.lastSweep) > time.Minute {
+		l.sweep(now)
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+
+	return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+}
+
+// sweep forgets buckets that have refilled completely, as they are no
+// different from a new one.
+func (l *rateLimiter) sweep(now time.Time) {
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+
+	l.lastSweep = now
+}
+
+var (
+	requestLimiter *rateLimiter
+
+	// retryAfterDate sends Retry-After as an HTTP-date rather than as
+	// delta-seconds.
+	retryAfterDate bool
+
+	tooManyRequestsError   = errorJSON(429, "Too many requests; try again later.")
+	tooManyConcurrentError = errorJSON(429, "Too many requests in progress; wait for one to finish.")
+)
+
+// retryAfter formats the Retry-After value for a wait of d from now, rounding
+// up so that clients never retry before a token is available.
+func retryAfter(now time.Time, d time.Duration) string {
+	seconds := int64(math.Ceil(d.Seconds()))
+	if retryAfterDate {
+		return now.Add(time.Duration(seconds) * time.Second).UTC().Format(http.TimeFormat)
+	}
+
+	return strconv.FormatInt(seconds, 10)
+}
+
+// clientConcurrency counts the requests each client has in flight, so that
+// one client holding many slow requests open can't take every connection
+// slot. It counts requests rather than connections so that clients behind a
+// trusted proxy, which share its connections, are told apart; connections
+// themselves are limited by peerConnections.
+type clientConcurrency struct {
+	limit int
+
+	mu     sync.Mutex
+	active map[string]int
+	total  int
+}
+
+func newClientConcurrency(limit int) *clientConcurrency {
+	return &clientConcurrency{limit: limit, active: make(map[string]int)}
+}
+
+// acquire counts a request from client, returning false if the client
+// already has limit requests in flight.
+func (c *clientConcurrency) acquire(client string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.active[client] >= c.limit {
+		return false
+	}
+
+	c.active[client]++
+	c.total++
+	return true
+}
+
+func (c *clientConcurrency) release(client string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.active[client]--; c.active[client] <= 0 {
+		delete(c.active, client)
+	}
+	c.total--
+}
+
+// stats returns the number of requests in flight and of clients making them.
+func (c *clientConcurrency) stats() (requests, clients int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.total, len(c.active)
+}
+
+var (
+	clientLimiter *clientConcurrency
+
+	clientConcurrencyRejected = newCounter("xmppresolv_client_concurrency_rejected_total", "Requests refused because the client had too many in flight.")
+)
+
+func init() {
+	newGauge("xmppresolv_client_requests_in_flight", "Requests in flight counted against -max-client-concurrency.", func() float64 {
+		if clientLimiter == nil {
+			return 0
+		}
+
+		requests, _ := clientLimiter.stats()
+		return float64(requests)
+	})
+
+	newGauge("xmppresolv_clients_in_flight", "Clients with requests in flight.", func() float64 {
+		if clientLimiter == nil {
+			return 0
+		}
+
+		_, clients := clientLimiter.stats()
+		return float64(clients)
+	})
+}
+
+// rateLimited wraps a handler so that each client is limited by
+// requestLimiter and clientLimiter, if set.
+func rateLimited(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if requestLimiter == nil && clientLimiter == nil {
+			next(w, r)
+			return
+		}
+
+		client := clientIP(r)
+		h := w.Header()
+
+		now := time.Now()
+		if requestLimiter != nil {
+			if ok, wait := requestLimiter.take(client, now); !ok {
+				h.Set("Content-Type", "application/json; charset=utf-8")
+				h.Set("Retry-After", retryAfter(now, wait))
+				httpError(w, tooManyRequestsError, http.StatusTooManyRequests)
+				return
+			}
+		}
+
+		if clientLimiter != nil {
+			if !clientLimiter.acquire(client) {
+				clientConcurrencyRejected.inc()
+				h.Set("Content-Type", "application/json; charset=utf-8")
+				h.Set("Retry-After", retryAfter(now, time.Second))
+				httpError(w, tooManyConcurrentError, http.StatusTooManyRequests)
+				return
+			}
+			defer clientLimiter.release(client)
+		}
+
+		next(w, r)
+	}
+}
+
+// peerConnections counts the connections open from each peer, so that one
+// opening many idle or slow connections, which are never counted as
+// requests until their headers arrive, can't take every connection slot.
+// Connections from trusted proxies aren't counted, as the clients behind
+// them share their connections and are told apart by clientConcurrency.
+type peerConnections struct {
+	limit int
+
+	mu    sync.Mutex
+	open  map[string]int
+	total int
+}
+
+func newPeerConnections(limit int) *peerConnections {
+	return &peerConnections{limit: limit, open: make(map[string]int)}
+}
+
+func (c *peerConnections) acquire(peer string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.open[peer] >= c.limit {
+		return false
+	}
+
+	c.open[peer]++
+	c.total++
+	return true
+}
+
+func (c *peerConnections) release(peer string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.open[peer]--; c.open[peer] <= 0 {
+		delete(c.open, peer)
+	}
+	c.total--
+}
+
+// stats returns the number of connections counted and of peers with them.
+func (c *peerConnections) stats() (connections, peers int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.total, len(c.open)
+}
+
+// listener returns l with the connections of each peer limited. Those
+// beyond the limit are answered with 429 and closed without being served.
+func (c *peerConnections) listener(l net.Listener) net.Listener {
+	return &limitedListener{Listener: l, conns: c}
+}
+
+type limitedListener struct {
+	net.Listener
+	conns *peerConnections
+}
+
+func (l *limitedListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		peer, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+		if ip := net.ParseIP(peer); err != nil || ip == nil || containsIP(trustedProxies, ip) {
+			return conn, nil
+		}
+
+		if !l.conns.acquire(peer) {
+			peerConnectionsRejected.inc()
+			go rejectConn(conn)
+			continue
+		}
+
+		return &countedConn{Conn: conn, release: func() { l.conns.release(peer) }}, nil
+	}
+}
+
+// countedConn is a connection counted against its peer until it is closed,
+// even if its handler hijacks it.
+type countedConn struct {
+	net.Conn
+
+	once    sync.Once
+	release func()
+}
+
+func (c *countedConn) Close() error {
+	c.once.Do(c.release)
+	return c.Conn.Close()
+}
+
+// rejectConn answers conn with 429 and closes it. Whatever the client sent
+// is read first, within a second, so that the close doesn't reset the
+// connection before the response arrives.
+func rejectConn(conn net.Conn) {
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(time.Second))
+	body := tooManyConnectionsError + "\n"
+	io.WriteString(conn, "HTTP/1.1 429 Too Many Requests\r\n"+
+		"Content-Type: application/json; charset=utf-8\r\n"+
+		"Retry-After: 1\r\n"+
+		"Connection: close\r\n"+
+		"Content-Length: "+strconv.Itoa(len(body))+"\r\n\r\n"+body)
+
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		tcp.CloseWrite()
+		io.Copy(io.Discard, io.LimitReader(conn, 64<<10))
+	}
+}
+
+var (
+	connectionLimiter *peerConnections
+
+	tooManyConnectionsError = errorJSON(429, "Too many connections open; close one first.")
+
+	peerConnectionsRejected = newCounter("xmppresolv_client_connections_rejected_total", "Connections refused because the peer had too many open.")
+)
+
+func init() {
+	newGauge("xmppresolv_client_connections_open", "Connections open counted against -max-client-connections.", func() float64 {
+		if connectionLimiter == nil {
+			return 0
+		}
+
+		connections, _ := connectionLimiter.stats()
+		return float64(connections)
+	})
+
+	newGauge("xmppresolv_clients_connected", "Peers with connections open counted against -max-client-connections.", func() float64 {
+		if connectionLimiter == nil {
+			return 0
+		}
+
+		_, peers := connectionLimiter.stats()
+		return float64(peers)
+	})
+}
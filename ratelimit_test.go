@@ -0,0 +1,161 @@
+// Copyright 2015 Michael Johnson. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterRetryAfter(t *testing.T) {
+	l := newRateLimiter(2, 2)
+	now := time.Date(2015, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.take("client", now); !ok {
+			t.Fatalf("request %d refused within the burst", i+1)
+		}
+	}
+
+	tests := []struct {
+		after   time.Duration
+		wait    time.Duration
+		seconds string
+	}{
+		// The bucket is empty, and refills a token every half second.
+		{0, 500 * time.Millisecond, "1"},
+		{200 * time.Millisecond, 300 * time.Millisecond, "1"},
+	}
+
+	for _, tt := range tests {
+		at := now.Add(tt.after)
+		ok, wait := l.take("client", at)
+		if ok || wait != tt.wait {
+			t.Errorf("after %v: take = %t, %v; want false, %v", tt.after, ok, wait, tt.wait)
+		}
+
+		if got := retryAfter(at, wait); got != tt.seconds {
+			t.Errorf("after %v: Retry-After = %q, want %q", tt.after, got, tt.seconds)
+		}
+	}
+
+	if ok, _ := l.take("other", now); !ok {
+		t.Error("another client was limited by the first one's bucket")
+	}
+
+	retryAfterDate = true
+	defer func() { retryAfterDate = false }()
+
+	if got, want := retryAfter(now, 1500*time.Millisecond), "Mon, 01 Jun 2015 12:00:02 GMT"; got != want {
+		t.Errorf("Retry-After as a date = %q, want %q", got, want)
+	}
+}
+
+func TestRateLimited(t *testing.T) {
+	requestLimiter = newRateLimiter(0.5, 1)
+	defer func() { requestLimiter = nil }()
+
+	handler := rateLimited(func(w http.ResponseWriter, r *http.Request) {})
+
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", "/example.test", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("first request: status %d, want 200", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", "/example.test", nil))
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "2" {
+		t.Errorf("second request: status %d, Retry-After %q; want 429 and 2", w.Code, w.Header().Get("Retry-After"))
+	}
+}
+
+// limitedServer starts a server whose connections are limited to limit per
+// peer, and returns a function dialing it.
+func limitedServer(t *testing.T, limiter *peerConnections) (dial func() net.Conn) {
+	t.Helper()
+
+	s := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	s.Listener = limiter.listener(s.Listener)
+	s.Start()
+	t.Cleanup(s.Close)
+
+	return func() net.Conn {
+		conn, err := net.Dial("tcp", s.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+
+		return conn
+	}
+}
+
+// getOver makes a request over conn and returns the response's status.
+func getOver(t *testing.T, conn net.Conn) int {
+	t.Helper()
+
+	fmt.Fprint(conn, "GET / HTTP/1.1\r\nHost: example.test\r\n\r\n")
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	return resp.StatusCode
+}
+
+func TestPeerConnections(t *testing.T) {
+	limiter := newPeerConnections(2)
+	dial := limitedServer(t, limiter)
+
+	// waitFor waits for the limiter to count n connections.
+	waitFor := func(n int) {
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			if open, _ := limiter.stats(); open == n {
+				return
+			}
+		}
+
+		open, _ := limiter.stats()
+		t.Fatalf("%d connections counted, want %d", open, n)
+	}
+
+	// Connections that never send a request still count.
+	idle := dial()
+	dial()
+	waitFor(2)
+
+	if code := getOver(t, dial()); code != http.StatusTooManyRequests {
+		t.Errorf("third connection: status %d, want 429", code)
+	}
+
+	idle.Close()
+	waitFor(1)
+
+	if code := getOver(t, dial()); code != http.StatusOK {
+		t.Errorf("after one closed: status %d, want 200", code)
+	}
+}
+
+func TestPeerConnectionsTrustedProxy(t *testing.T) {
+	saved := trustedProxies
+	trustedProxies, _ = parseNetworks("127.0.0.1")
+	t.Cleanup(func() { trustedProxies = saved })
+
+	dial := limitedServer(t, newPeerConnections(1))
+
+	dial()
+	if code := getOver(t, dial()); code != http.StatusOK {
+		t.Errorf("from a trusted proxy: status %d, want 200", code)
+	}
+}
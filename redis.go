@@ -0,0 +1,268 @@
+// Copyright 2015 Michael Johnson. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// redisCache is a cache backend shared by every instance pointed at the same
+// Redis server. It speaks just enough of the Redis protocol to get and set
+// entries.
+type redisCache struct {
+	addr     string
+	username string
+	password string
+	db       int
+	timeout  time.Duration
+
+	// idle holds connections available for reuse.
+	idle chan *redisConn
+}
+
+type redisConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+const redisKeyPrefix = "xmppresolv:"
+
+// newRedisCache parses a URL of the form redis://[[user]:password@]host[:port][/db].
+func newRedisCache(rawURL string, timeout time.Duration) (*redisCache, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme != "redis" {
+		return nil, fmt.Errorf("unsupported Redis URL scheme %q", u.Scheme)
+	}
+
+	c := &redisCache{
+		addr:    u.Host,
+		timeout: timeout,
+		idle:    make(chan *redisConn, 16),
+	}
+
+	if u.Port() == "" {
+		c.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+
+	if u.User != nil {
+		c.username = u.User.Username()
+		c.password, _ = u.User.Password()
+	}
+
+	if db := strings.TrimPrefix(u.Path, "/"); db != "" {
+		if c.db, err = strconv.Atoi(db); err != nil {
+			return nil, fmt.Errorf("invalid Redis database %q", db)
+		}
+	}
+
+	return c, nil
+}
+
+func (c *redisCache) conn() (*redisConn, error) {
+	select {
+	case conn := <-c.idle:
+		return conn, nil
+	default:
+	}
+
+	nc, err := net.DialTimeout("tcp", c.addr, c.timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	conn := &redisConn{Conn: nc, r: bufio.NewReader(nc)}
+
+	if c.password != "" {
+		args := []string{"AUTH", c.password}
+		if c.username != "" {
+			args = []string{"AUTH", c.username, c.password}
+		}
+
+		if _, err := c.do(conn, args...); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	if c.db != 0 {
+		if _, err := c.do(conn, "SELECT", strconv.Itoa(c.db)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	return conn, nil
+}
+
+func (c *redisCache) release(conn *redisConn) {
+	select {
+	case c.idle <- conn:
+	default:
+		conn.Close()
+	}
+}
+
+// errRedisNil is returned for a nil bulk reply, such as GET on a missing key.
+var errRedisNil = errors.New("redis: nil")
+
+// redisError is an error reply from the server. The connection is still
+// usable after one.
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+func (c *redisCache) do(conn *redisConn, args ...string) ([]byte, error) {
+	conn.SetDeadline(time.Now().Add(c.timeout))
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&buf, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+
+	if _, err := conn.Write(buf.Bytes()); err != nil {
+		return nil, err
+	}
+
+	line, err := conn.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("redis: empty reply")
+	}
+
+	switch line[0] {
+	case '+', ':':
+		return []byte(line[1:]), nil
+	case '-':
+		return nil, redisError(line[1:])
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("redis: invalid bulk length %q", line[1:])
+		}
+
+		if n < 0 {
+			return nil, errRedisNil
+		}
+
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(conn.r, data); err != nil {
+			return nil, err
+		}
+
+		return data[:n], nil
+	default:
+		return nil, fmt.Errorf("redis: unexpected reply %q", line)
+	}
+}
+
+// command runs a single command on a pooled connection, discarding the
+// connection if it is left in an unknown state.
+func (c *redisCache) command(args ...string) ([]byte, error) {
+	conn, err := c.conn()
+	if err != nil {
+		return nil, err
+	}
+
+	reply, err := c.do(conn, args...)
+	var rerr redisError
+	if err != nil && err != errRedisNil && !errors.As(err, &rerr) {
+		conn.Close()
+		return nil, err
+	}
+
+	c.release(conn)
+	return reply, err
+}
+
+// Entries are stored as a header line, then the body. The header is the ETag,
+// followed by " n" if the entry is non-authoritative, " exp=" and " at=" with
+// the Unix times it expires at and was resolved at, and " sig=" with its
+// signature, if it has one.
+func (c *redisCache) get(key string) (*cacheEntry, error) {
+	value, err := c.command("GET", redisKeyPrefix+key)
+	if err == errRedisNil {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	header, body, ok := bytes.Cut(value, []byte("\n"))
+	if !ok {
+		return nil, fmt.Errorf("malformed cache entry")
+	}
+
+	fields := strings.Fields(string(header))
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("malformed cache entry")
+	}
+
+	entry := &cacheEntry{Body: body, ETag: fields[0]}
+	for _, field := range fields[1:] {
+		if field == "n" {
+			entry.NonAuthoritative = true
+		} else if sig, ok := strings.CutPrefix(field, "sig="); ok {
+			entry.Signature = sig
+		} else if exp, ok := strings.CutPrefix(field, "exp="); ok {
+			unix, err := strconv.ParseInt(exp, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("malformed cache entry")
+			}
+			entry.Expires = time.Unix(unix, 0)
+		} else if at, ok := strings.CutPrefix(field, "at="); ok {
+			unix, err := strconv.ParseInt(at, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("malformed cache entry")
+			}
+			entry.Resolved = time.Unix(unix, 0)
+		}
+	}
+
+	return entry, nil
+}
+
+func (c *redisCache) set(key string, entry *cacheEntry, ttl time.Duration) error {
+	// Redis refuses an expiry under a millisecond, and the entry would
+	// already be stale anyway.
+	ms := ttl.Milliseconds()
+	if ms <= 0 {
+		return nil
+	}
+
+	header := entry.ETag
+	if entry.NonAuthoritative {
+		header += " n"
+	}
+	header += " exp=" + strconv.FormatInt(entry.Expires.Unix(), 10)
+	header += " at=" + strconv.FormatInt(entry.Resolved.Unix(), 10)
+	if entry.Signature != "" {
+		header += " sig=" + entry.Signature
+	}
+
+	value := header + "\n" + string(entry.Body)
+	_, err := c.command("SET", redisKeyPrefix+key, value, "PX", strconv.FormatInt(ms, 10))
+	return err
+}
@@ -0,0 +1,44 @@
+// Copyright 2015 Michael Johnson. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRedisSetExpired(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	connected := make(chan bool, 1)
+	go func() {
+		if conn, err := l.Accept(); err == nil {
+			connected <- true
+			conn.Close()
+		}
+	}()
+
+	c, err := newRedisCache("redis://"+l.Addr().String(), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, ttl := range []time.Duration{-time.Second, 0, time.Microsecond} {
+		if err := c.set("key", &cacheEntry{Body: []byte("{}")}, ttl); err != nil {
+			t.Errorf("set with TTL %v: %v", ttl, err)
+		}
+	}
+
+	select {
+	case <-connected:
+		t.Error("an expired entry was written to Redis")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -0,0 +1,689 @@
+// Copyright 2015 Michael Johnson. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// searchDomains are appended in turn to names that have no records of their
+// own, like the search directive of resolv.conf.
+var searchDomains []string
+
+// resolveSearch resolves domain, falling back to each of the search domains
+// if it has no records, and then with probe-subdomains=true, to each of the
+// conventional subdomains. When a fallback matches, the name that was
+// actually resolved is reported in the response. With debug=dns, the response
+// includes every DNS exchange made along the way, and with hints=true, a 404
+// says what the domain has instead of records.
+func resolveSearch(ctx context.Context, domain string, opts *options) (data *responseData, rerr *requestError) {
+	if opts.debugDNS {
+		trace := &dnsTrace{}
+		ctx = withDNSTrace(ctx, trace)
+		defer func() {
+			if data != nil {
+				data.Debug = &debugInfo{DNS: trace.list()}
+			}
+		}()
+	}
+
+	// A domain that disabled the service has answered, so the fallbacks
+	// aren't tried.
+	data, rerr = resolve(ctx, domain, opts)
+	if rerr == nil || rerr.code != http.StatusNotFound || rerr.body == serviceDisabledError {
+		return data, rerr
+	}
+
+	for _, search := range searchDomains {
+		name := strings.TrimSuffix(domain, ".") + "." + search
+		if !domainPermitted(name) {
+			continue
+		}
+
+		if data, err := resolve(ctx, name, opts); err == nil {
+			data.Domain = name
+			return data, nil
+		} else if err.code != http.StatusNotFound || err.body == serviceDisabledError {
+			return nil, err
+		}
+	}
+
+	if opts.probeSubdomains {
+		if data := resolveSubdomains(ctx, domain, opts); data != nil {
+			return data, nil
+		}
+	}
+
+	if opts.hints && rerr.body == notFoundError {
+		rerr = &requestError{rerr.code, withHints(rerr.body, domainHints(ctx, domain))}
+	}
+
+	return nil, rerr
+}
+
+// maxConventionalSubdomains bounds the number of -conventional-subdomains,
+// as each is a full set of lookups.
+const maxConventionalSubdomains = 5
+
+// conventionalSubdomains are where providers commonly host XMPP without
+// publishing records for the domain itself.
+var conventionalSubdomains = []string{"xmpp", "chat", "jabber"}
+
+// resolveSubdomains resolves each conventional subdomain of domain in turn,
+// returning the first that has records, or nil if none do. They are resolved
+// one at a time, so the request stays within its lookup limits, and all
+// under one lookup deadline. As the records weren't published for the
+// domain, the response is marked non-authoritative and carries a warning.
+func resolveSubdomains(ctx context.Context, domain string, opts *options) *responseData {
+	if lookupDeadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, lookupDeadline)
+		defer cancel()
+	}
+
+	domain = strings.TrimSuffix(domain, ".")
+	for _, sub := range conventionalSubdomains {
+		name := sub + "." + domain
+		if !domainPermitted(name) {
+			continue
+		}
+
+		data, rerr := resolve(ctx, name, opts)
+		if rerr != nil {
+			if rerr.code != http.StatusNotFound {
+				log.Printf("Error probing subdomain %q of %q: %s", sub, domain, rerr.body)
+			}
+			continue
+		}
+
+		data.Domain = name
+		data.NonAuthoritative = true
+		data.Warnings = append(data.Warnings, fmt.Sprintf("%s has no XMPP records of its own; these are those of %s.", domain, name))
+		return data
+	}
+
+	return nil
+}
+
+// isNotFound reports whether err means that the name looked up does not
+// exist. Only the structured error is consulted, as messages differ between
+// resolver implementations and platforms.
+func isNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
+
+// isPartial reports whether records returned alongside err can be used.
+// The resolver returns the valid records along with an error when others in
+// the response were malformed, and those are served with a warning. After a
+// timeout or temporary failure the records may be incomplete in ways that
+// would mislead clients, so those still fail the request.
+func isPartial(err error) bool {
+	var dnsErr *net.DNSError
+	if !errors.As(err, &dnsErr) {
+		return false
+	}
+
+	return !dnsErr.IsTimeout && !dnsErr.IsTemporary && !dnsErr.IsNotFound
+}
+
+// lookupError returns the response for a failed lookup, including err itself
+// if opts asks for it.
+func lookupError(err error, opts *options) *requestError {
+	rerr := &requestError{http.StatusInternalServerError, internalServerError}
+	if errors.Is(err, errQueryBudget) {
+		rerr = &requestError{http.StatusServiceUnavailable, overloadedError}
+	}
+
+	if opts.debugErrors {
+		rerr.body = withDetail(rerr.body, err)
+	}
+
+	return rerr
+}
+
+// lookupDeadline bounds all of the DNS lookups made to resolve a domain
+// together, however many there are.
+var lookupDeadline = 10 * time.Second
+
+// failedLookupTTL caps the TTL, in seconds, of a response that is missing
+// records because some of its lookups failed.
+const failedLookupTTL = 30
+
+// srvTransports returns the transports to look up SRV records under for
+// opts, client transports first.
+func srvTransports(opts *options) []*transport {
+	switch opts.serviceType {
+	case typeServer:
+		return enabledServerTransports()
+	case typeAll, typeBoth:
+		return append(enabledTransports[:len(enabledTransports):len(enabledTransports)], enabledServerTransports()...)
+	default:
+		return enabledTransports
+	}
+}
+
+// resolve looks up the records for domain and assembles them into a
+// response.
+//
+// For type=all and type=both, every lookup runs concurrently under the
+// shared deadline and one failing only adds a warning, so that a broken
+// server-to-server record doesn't hide working client ones or vice versa. The
+// request only fails if nothing could be found and something failed. Each
+// role is ordered on its own, and for type=both, the two are only put in one
+// list at the end.
+func resolve(ctx context.Context, domain string, opts *options) (*responseData, *requestError) {
+	if lookupDeadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, lookupDeadline)
+		defer cancel()
+	}
+
+	g := newLookupGroup(ctx)
+
+	bothRoles := opts.serviceType == typeAll || opts.serviceType == typeBoth
+	transports := srvTransports(opts)
+	srvLookups := make([]*srvLookup, len(transports))
+	for i, t := range transports {
+		srvLookups[i] = g.srv(t.service, t.proto, domain)
+	}
+
+	// Alternative connection methods are only published for clients.
+	var txtResult *txtLookup
+	if opts.serviceType != typeServer {
+		txtResult = g.txt("_xmppconnect." + domain)
+	}
+
+	// The host-meta document is fetched at the same time as the DNS
+	// lookups, so that it doesn't add to their latency.
+	var webResult *hostMetaLookup
+	if opts.web && opts.serviceType != typeServer {
+		webResult = g.hostMeta(domain)
+	}
+
+	var soaResult *soaLookup
+	if opts.meta {
+		soaResult = g.soa(domain)
+	}
+
+	var dnssecChecks []*dnssecCheck
+	if opts.dnssecStrict {
+		for _, t := range transports {
+			dnssecChecks = append(dnssecChecks, g.dnssec("_"+t.service+"._"+t.proto+"."+domain, dnsTypeSRV))
+		}
+
+		if txtResult != nil {
+			dnssecChecks = append(dnssecChecks, g.dnssec("_xmppconnect."+domain, dnsTypeTXT))
+		}
+	}
+
+	g.wait()
+
+	// Strict clients are only given records known to have validated, so
+	// a check that couldn't be made, such as when there are no nameservers
+	// to ask or only the check timed out, fails the request too.
+	for _, c := range dnssecChecks {
+		if c.err != nil {
+			log.Printf("Error checking DNSSEC validation for %q: %v", domain, c.err)
+			if errors.Is(c.err, errQueryBudget) {
+				return nil, lookupError(c.err, opts)
+			}
+
+			rerr := &requestError{http.StatusBadGateway, dnssecUncheckedError}
+			if opts.debugErrors {
+				rerr.body = withDetail(rerr.body, c.err)
+			}
+
+			return nil, rerr
+		}
+
+		if c.bogus {
+			return nil, &requestError{http.StatusBadGateway, dnssecError}
+		}
+	}
+
+	var (
+		srvFound   = false
+		servers    = make(serverList, 0)
+		s2sServers serverList
+		warnings   []string
+		failure    error
+		disabled   bool
+		ttl        int64 = unknownTTL
+
+		// answered are the roles with SRV records, or whose lookups
+		// failed, for which there is no fallback.
+		answered = make(map[string]bool)
+	)
+
+	for i, t := range transports {
+		l := srvLookups[i]
+		if l.err != nil && len(l.records) > 0 && isPartial(l.err) {
+			log.Printf("Partial %s SRV records for %q: %v", t.service, domain, l.err)
+			warnings = append(warnings, fmt.Sprintf("Some %s %s SRV records were invalid and have been left out.", t.name, t.role))
+		} else if l.err != nil {
+			if !isNotFound(l.err) {
+				if t.experimental {
+					// Experimental transports must never break the
+					// response for the established ones.
+					log.Printf("Error resolving %s SRV records for %q: %v", t.name, domain, l.err)
+					continue
+				}
+
+				log.Printf("Error resolving %s SRV records for %q: %v", t.service, domain, l.err)
+				answered[t.role] = true
+				if !bothRoles {
+					return nil, lookupError(l.err, opts)
+				}
+
+				if failure == nil {
+					failure = l.err
+				}
+				warnings = append(warnings, fmt.Sprintf("The %s %s SRV records could not be resolved.", t.name, t.role))
+			}
+
+			continue
+		}
+
+		srvFound = true
+		answered[t.role] = true
+		ttl = minKnownTTL(ttl, l.ttl)
+
+		// A lone record with the target "." says that the service is
+		// decidedly not available (RFC 2782). Anywhere else it is
+		// meaningless, so it is always left out.
+		if len(l.records) == 1 && l.records[0].Target == "." {
+			disabled = true
+			continue
+		}
+
+		for _, service := range l.records {
+			if service.Target == "." {
+				continue
+			}
+
+			s := &server{
+				Target:    service.Target,
+				Port:      service.Port,
+				Priority:  service.Priority,
+				Weight:    service.Weight,
+				Transport: t.label,
+				Source:    sourceSRV,
+				ttl:       l.ttl,
+				via:       t,
+			}
+
+			if bothRoles && t.role == roleServer {
+				s2sServers = append(s2sServers, s)
+			} else {
+				servers = append(servers, s)
+			}
+		}
+	}
+
+	var dropped, droppedS2S, droppedFallback int
+	servers, dropped = permittedTargets(domain, servers)
+	s2sServers, droppedS2S = permittedTargets(domain, s2sServers)
+
+	var fallback serverList
+	if opts.fallback {
+		fallback, droppedFallback = permittedTargets(domain, fallbackServers(ctx, domain, transports, answered))
+		for _, s := range fallback {
+			if bothRoles && s.via.role == roleServer {
+				s2sServers = append(s2sServers, s)
+			} else {
+				servers = append(servers, s)
+			}
+
+			warnings = append(warnings, fmt.Sprintf("There are no %s SRV records, so the domain itself is given on port %d, as RFC 6120 specifies.", s.via.role, s.Port))
+		}
+	}
+
+	if n := dropped + droppedS2S + droppedFallback; n > 0 {
+		warnings = append(warnings, fmt.Sprintf("Servers whose targets are outside the domains this service permits were left out (%d).", n))
+	}
+
+	txtFound := false
+	var txt []string
+	if txtResult != nil {
+		txtFound, txt = true, txtResult.records
+		if err := txtResult.err; err == nil {
+			ttl = minKnownTTL(ttl, txtResult.ttl)
+		} else {
+			txtFound = false
+
+			if !isNotFound(err) {
+				log.Printf("Error resolving TXT records for %q: %v", domain, err)
+				if !bothRoles {
+					return nil, lookupError(err, opts)
+				}
+
+				if failure == nil {
+					failure = err
+				}
+				warnings = append(warnings, "The alternative connection methods could not be resolved.")
+			}
+		}
+	}
+
+	var web []*alternative
+	if webResult != nil {
+		if err := webResult.err; err == nil {
+			web = hostMetaAlternatives(webResult.links)
+		} else if err != errNoHostMeta {
+			log.Printf("Error fetching host-meta for %q: %v", domain, err)
+			warnings = append(warnings, "The host-meta document could not be fetched.")
+		}
+	}
+
+	if !txtFound && !srvFound && len(web) == 0 && len(fallback) == 0 {
+		if failure != nil {
+			return nil, lookupError(failure, opts)
+		}
+
+		return nil, &requestError{http.StatusNotFound, notFoundError}
+	}
+
+	// A failure may only be momentary, so what was found is only kept
+	// briefly rather than hiding the rest for the full TTL.
+	if failure != nil {
+		ttl = minKnownTTL(ttl, failedLookupTTL)
+	}
+
+	data := &responseData{
+		Servers:      servers,
+		Alternatives: make([]*alternative, 0, len(txt)),
+		S2SServers:   s2sServers,
+		Warnings:     warnings,
+		domain:       domain,
+		ttl:          ttl,
+	}
+
+	for _, rec := range txt {
+		split := strings.SplitN(rec, "=", 2)
+		if len(split) != 2 {
+			continue
+		}
+
+		name := split[0]
+		if !strings.HasPrefix(strings.ToLower(name), "_xmpp-client-") {
+			continue
+		}
+
+		name = name[13:]
+
+		data.Alternatives = append(data.Alternatives, &alternative{
+			Name:  name,
+			Value: canonicalURL(split[1]),
+
+			Source: sourceTXT,
+			ttl:    txtResult.ttl,
+		})
+	}
+
+	data.Alternatives = append(data.Alternatives, web...)
+	data.Capabilities = parseCapabilities(txt)
+
+	// Records may have been found and all left out, which is the same as
+	// there being none, unless the service was explicitly disabled.
+	if len(data.Servers) == 0 && len(data.Alternatives) == 0 && len(data.S2SServers) == 0 {
+		if disabled {
+			return nil, &requestError{http.StatusNotFound, serviceDisabledError}
+		}
+
+		return nil, &requestError{http.StatusNotFound, notFoundError}
+	}
+
+	// The serial is only a hint, so failing to fetch it doesn't fail the
+	// request.
+	if soaResult != nil {
+		if soaResult.err != nil {
+			log.Printf("Error resolving SOA record for %q: %v", domain, soaResult.err)
+		} else {
+			data.Meta = &meta{
+				Zone:   soaResult.record.zone,
+				Serial: soaResult.record.serial,
+			}
+		}
+	}
+
+	sort.Sort(data.Servers)
+	sort.Sort(data.S2SServers)
+
+	if opts.profile == profileMobile {
+		data.Servers = data.Servers.firstPerPriority()
+		data.S2SServers = data.S2SServers.firstPerPriority()
+	}
+
+	for _, s := range data.allServers() {
+		data.NonAuthoritative = data.NonAuthoritative || s.Source != sourceSRV
+	}
+
+	for _, a := range data.Alternatives {
+		data.NonAuthoritative = data.NonAuthoritative || a.Source != sourceTXT
+	}
+
+	if opts.advice || opts.scheme {
+		for _, s := range data.allServers() {
+			if opts.advice {
+				s.Advice = s.via.advice()
+			}
+
+			if opts.scheme {
+				s.Scheme = s.via.scheme()
+			}
+		}
+	}
+
+	if opts.order == orderRTT {
+		orderByRTT(ctx, data)
+	}
+
+	if opts.recommended {
+		if opts.order == orderRTT {
+			data.Recommended = recommend(data.Servers)
+		} else {
+			data.Recommended = recommend(data.Servers.inPreferenceOrder())
+		}
+	}
+
+	if opts.rank {
+		if opts.order == orderRTT {
+			data.Servers.rankAsListed()
+			data.S2SServers.rankAsListed()
+		} else {
+			data.Servers.rank()
+			data.S2SServers.rank()
+		}
+	}
+
+	sort.Sort(data.Alternatives)
+	data.Alternatives = data.Alternatives.dedup()
+
+	if opts.unicode {
+		for _, s := range data.allServers() {
+			s.TargetUnicode = toUnicode(s.Target)
+		}
+
+		for _, a := range data.Alternatives {
+			a.HostUnicode = toUnicode(a.host())
+		}
+	}
+
+	if opts.recordMaxAge {
+		for _, s := range data.allServers() {
+			s.MaxAge = recordMaxAge(s.ttl)
+		}
+
+		for _, a := range data.Alternatives {
+			a.MaxAge = recordMaxAge(a.ttl)
+		}
+	}
+
+	// Diagnostic responses may not reflect the domain's real records.
+	if !opts.diagnostic() {
+		reverseTargets.record(domain, transports, data.allServers())
+	}
+
+	if opts.resolve {
+		resolveAddresses(ctx, data)
+	}
+
+	if opts.validate {
+		validate(data)
+	}
+
+	if opts.checkTLS {
+		checkTLS(ctx, domain, data)
+	}
+
+	if opts.probe {
+		probeServers(ctx, domain, data)
+	}
+
+	if opts.serviceType == typeBoth {
+		data.Servers = withRoles(data.Servers, data.S2SServers, opts.order == orderRTT)
+		data.S2SServers = nil
+	}
+
+	return data, nil
+}
+
+// fallbackServers returns the servers RFC 6120 has clients fall back to for
+// the roles of transports that aren't answered: the domain itself on the
+// role's default port. They are only returned if the domain has addresses,
+// as otherwise there is nothing to connect to.
+func fallbackServers(ctx context.Context, domain string, transports []*transport, answered map[string]bool) serverList {
+	var fallback serverList
+	for _, t := range transports {
+		if t.defaultPort == 0 || answered[t.role] {
+			continue
+		}
+
+		answered[t.role] = true
+		fallback = append(fallback, &server{
+			Target:    strings.TrimSuffix(domain, ".") + ".",
+			Port:      t.defaultPort,
+			Transport: t.label,
+			Source:    sourceFallback,
+			ttl:       unknownTTL,
+			via:       t,
+		})
+	}
+
+	if len(fallback) == 0 {
+		return nil
+	}
+
+	g := newLookupGroup(ctx)
+	l := g.ip(domain)
+	g.wait()
+
+	if l.err != nil {
+		if !isNotFound(l.err) {
+			log.Printf("Error resolving the fallback addresses of %q: %v", domain, l.err)
+		}
+
+		return nil
+	}
+
+	if len(l.addrs) == 0 {
+		return nil
+	}
+
+	return fallback
+}
+
+// recordMaxAge returns the maxAge of a record with ttl, for record-max-age.
+func recordMaxAge(ttl int64) *int {
+	maxAge := maxAgeFor(ttl)
+	return &maxAge
+}
+
+// minKnownTTL returns the smaller of two TTLs, ignoring unknown ones.
+func minKnownTTL(a, b int64) int64 {
+	switch {
+	case a == unknownTTL:
+		return b
+	case b == unknownTTL:
+		return a
+	default:
+		return min(a, b)
+	}
+}
+
+// resolveAddresses looks up the addresses of every server target and
+// alternative host in data. Hosts that fail to resolve are left without
+// addresses, and with -filter-internal-addresses, internal addresses are
+// left out with a warning.
+func resolveAddresses(ctx context.Context, data *responseData) {
+	g := newLookupGroup(ctx)
+	lookups := make(map[string]*ipLookup)
+
+	lookup := func(host string) {
+		host = strings.TrimSuffix(host, ".")
+		if host == "" || lookups[host] != nil {
+			return
+		}
+
+		if ip := net.ParseIP(host); ip != nil {
+			lookups[host] = &ipLookup{addrs: []net.IPAddr{{IP: ip}}}
+			return
+		}
+
+		lookups[host] = g.ip(host)
+	}
+
+	for _, s := range data.allServers() {
+		lookup(s.Target)
+	}
+
+	for _, a := range data.Alternatives {
+		lookup(a.host())
+	}
+
+	g.wait()
+
+	filtered := make(map[string]bool)
+	addresses := func(host string) []string {
+		host = strings.TrimSuffix(host, ".")
+		l := lookups[host]
+		if l == nil || l.err != nil {
+			return nil
+		}
+
+		var out []string
+		for _, addr := range l.addrs {
+			if filterInternalAddresses && isInternal(addr.IP) {
+				if !filtered[host] {
+					filtered[host] = true
+					data.Warnings = append(data.Warnings, fmt.Sprintf("Internal addresses of %s have been left out.", host))
+				}
+				continue
+			}
+
+			out = append(out, addr.String())
+		}
+		sort.Strings(out)
+
+		return out
+	}
+
+	for _, s := range data.allServers() {
+		s.Addresses = addresses(s.Target)
+	}
+
+	for _, a := range data.Alternatives {
+		a.Addresses = addresses(a.host())
+	}
+}
@@ -0,0 +1,272 @@
+// Copyright 2015 Michael Johnson. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPartialFailureTTL(t *testing.T) {
+	useFixtures(t,
+		srvFixture("_xmpp-client._tcp.example.test", 0, 0, 5222, "xmpp.example.test"),
+		fixture{"_xmppconnect.example.test", dnsTypeTXT, 60, []byte{20, 'a', 'b'}},
+	)
+
+	w := get(t, "/example.test?type=all")
+	if w.Code != 200 || !strings.Contains(w.Body.String(), "could not be resolved") {
+		t.Fatalf("status %d, body %s; want a partial response", w.Code, w.Body)
+	}
+
+	if got, want := w.Header().Get("Cache-Control"), "public, max-age="+strconv.Itoa(failedLookupTTL); got != want {
+		t.Errorf("Cache-Control = %q, want %q", got, want)
+	}
+}
+
+func TestServeSources(t *testing.T) {
+	useFixtures(t,
+		srvFixture("_xmpp-client._tcp.example.test", 0, 0, 5222, "xmpp.example.test"),
+		txtFixture("_xmppconnect.example.test", 60, "_xmpp-client-websocket=wss://xmpp.example.test/ws"),
+		aFixture("example.test", "192.0.2.1"),
+	)
+
+	// The client role has SRV records and the server role falls back to
+	// the domain itself.
+	data := getData(t, "/example.test?type=all&fallback=true")
+
+	sources := func(servers serverList) (list []string) {
+		for _, s := range servers {
+			list = append(list, s.Target+" "+s.Source)
+		}
+		return list
+	}
+
+	if got, want := sources(data.Servers), []string{"xmpp.example.test. srv"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("servers = %q, want %q", got, want)
+	}
+	if got, want := sources(data.S2SServers), []string{"example.test. fallback"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("s2sServers = %q, want %q", got, want)
+	}
+	if len(data.Alternatives) != 1 || data.Alternatives[0].Source != sourceTXT {
+		t.Errorf("alternatives = %+v, want one from TXT", data.Alternatives)
+	}
+
+	links := []hostMetaLink{
+		{Rel: altConnectionsPrefix + "websocket", Href: "wss://xmpp.example.test/ws"},
+		{Rel: "lrdd", Href: "https://example.test/lrdd"},
+	}
+	if alts := hostMetaAlternatives(links); len(alts) != 1 || alts[0].Source != sourceHostMeta {
+		t.Errorf("host-meta alternatives = %+v, want one from host-meta", alts)
+	}
+}
+
+func TestIsPartial(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{&net.DNSError{Err: "DNS response contained records which contain invalid names"}, true},
+		{&net.DNSError{Err: "i/o timeout", IsTimeout: true}, false},
+		{&net.DNSError{Err: "server misbehaving", IsTemporary: true}, false},
+		{&net.DNSError{Err: "no such host", IsNotFound: true}, false},
+		{errors.New("not a DNS error"), false},
+	}
+
+	for _, tt := range tests {
+		if got := isPartial(tt.err); got != tt.want {
+			t.Errorf("isPartial(%v) = %t, want %t", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestServePartialSRV(t *testing.T) {
+	useFixtures(t,
+		srvFixture("_xmpp-client._tcp.example.test", 0, 0, 5222, "xmpp.example.test"),
+		srvFixture("_xmpp-client._tcp.example.test", 0, 0, 5222, "not!valid.example.test"),
+	)
+
+	// The valid record is served, with a warning about the other.
+	data := getData(t, "/example.test")
+	if len(data.Servers) != 1 || data.Servers[0].Target != "xmpp.example.test." {
+		t.Errorf("servers = %+v, want only the valid one", data.Servers)
+	}
+	if len(data.Warnings) != 1 || !strings.Contains(data.Warnings[0], "invalid") {
+		t.Errorf("warnings = %q, want one about the invalid record", data.Warnings)
+	}
+}
+
+func TestIsNotFound(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{&net.DNSError{Err: "no such host", IsNotFound: true}, true},
+		{systemLookupError(&net.DNSError{Err: "DNS name does not exist."}), true},
+		{&net.DNSError{Err: "no such host"}, false},
+		{&net.DNSError{Err: "i/o timeout", IsTimeout: true}, false},
+		{errors.New("no such host"), false},
+	}
+
+	for _, tt := range tests {
+		if got := isNotFound(tt.err); got != tt.want {
+			t.Errorf("isNotFound(%v) = %t, want %t", tt.err, got, tt.want)
+		}
+	}
+}
+
+// TestResolverImplementations checks that the wire client and the standard
+// library resolver, used when there is no resolv.conf, give the same
+// responses.
+func TestResolverImplementations(t *testing.T) {
+	for _, impl := range []string{"wire", "stdlib"} {
+		t.Run(impl, func(t *testing.T) {
+			useFixtures(t,
+				srvFixture("_xmpp-client._tcp.example.test", 0, 0, 5222, "xmpp.example.test"),
+				txtFixture("_xmppconnect.example.test", 60, "_xmpp-client-websocket=wss://xmpp.example.test/ws"),
+				srvFixture("_xmpp-client._tcp.disabled.test", 0, 0, 0, "."),
+				aFixture("web.test", "192.0.2.1"),
+			)
+			if impl == "stdlib" {
+				wireClient = &dnsClient{}
+			}
+
+			data := getData(t, "/example.test")
+			if len(data.Servers) != 1 || data.Servers[0].Target != "xmpp.example.test." {
+				t.Errorf("servers = %+v, want xmpp.example.test.", data.Servers)
+			}
+			if len(data.Alternatives) != 1 || data.Alternatives[0].Value != "wss://xmpp.example.test/ws" {
+				t.Errorf("alternatives = %+v, want the websocket URL", data.Alternatives)
+			}
+
+			for target, want := range map[string]string{
+				"/missing.test":  notFoundError,
+				"/web.test":      notFoundError,
+				"/disabled.test": serviceDisabledError,
+			} {
+				if w := get(t, target); w.Code != 404 || w.Body.String() != want+"\n" {
+					t.Errorf("%s: status %d, body %s; want 404 %s", target, w.Code, w.Body, want)
+				}
+			}
+		})
+	}
+}
+
+func TestFilteredToNothing(t *testing.T) {
+	useFixtures(t,
+		srvFixture("_xmpp-client._tcp.disabled.test", 0, 0, 0, "."),
+		txtFixture("_xmppconnect.disabled.test", 60, "_xmpp-client-websocket=wss://disabled.test/ws"),
+		srvFixture("_xmpp-client._tcp.dot-and-real.test", 0, 0, 0, "."),
+		srvFixture("_xmpp-client._tcp.dot-and-real.test", 5, 0, 5222, "xmpp.dot-and-real.test"),
+		srvFixture("_xmpp-client._tcp.no-client.test", 0, 0, 0, "."),
+		srvFixture("_xmpp-server._tcp.no-client.test", 0, 0, 5269, "xmpp.no-client.test"),
+		srvFixture("_xmpp-client._tcp.dot-only.test", 0, 0, 0, "."),
+		txtFixture("_xmppconnect.dot-only.test", 60, "v=spf1 -all"),
+		txtFixture("_xmppconnect.other-txt.test", 60, "v=spf1 -all", "_xmpp-server-websocket=wss://x"),
+		srvFixture("_xmpp-client._tcp.dot-only.test.search.test", 0, 0, 5222, "xmpp.search.test"),
+	)
+
+	saved := searchDomains
+	searchDomains = []string{"search.test"}
+	defer func() { searchDomains = saved }()
+
+	tests := []struct {
+		target string
+		want   string
+	}{
+		// The service is disabled, and other records and the search
+		// domains aren't consulted.
+		{"/dot-only.test", serviceDisabledError},
+		// TXT records without an alternative are the same as none.
+		{"/other-txt.test", notFoundError},
+	}
+
+	for _, tt := range tests {
+		if w := get(t, tt.target); w.Code != 404 || w.Body.String() != tt.want+"\n" {
+			t.Errorf("%s: status %d, body %s; want 404 %s", tt.target, w.Code, w.Body, tt.want)
+		}
+	}
+
+	// Alternatives are still served when SRV is disabled.
+	if data := getData(t, "/disabled.test"); len(data.Servers) != 0 || len(data.Alternatives) != 1 {
+		t.Errorf("disabled.test: %+v, want only the alternative", data)
+	}
+
+	// Next to other records, "." is simply left out.
+	if data := getData(t, "/dot-and-real.test"); len(data.Servers) != 1 || data.Servers[0].Target != "xmpp.dot-and-real.test." {
+		t.Errorf("dot-and-real.test: servers %+v, want only the real one", data.Servers)
+	}
+
+	// A disabled client service doesn't hide server-to-server records.
+	if data := getData(t, "/no-client.test?type=all"); len(data.Servers) != 0 || len(data.S2SServers) != 1 {
+		t.Errorf("no-client.test: %+v, want only the s2s server", data)
+	}
+}
+
+func TestDNSSECStrictUnchecked(t *testing.T) {
+	useFixtures(t, srvFixture("_xmpp-client._tcp.example.test", 0, 0, 5222, "xmpp.example.test"))
+	getData(t, "/example.test?dnssec=strict")
+
+	// Without nameservers the lookups fall back to the standard library,
+	// but validation can't be checked.
+	wireClient = &dnsClient{}
+
+	getData(t, "/example.test")
+
+	w := get(t, "/example.test?dnssec=strict")
+	if w.Code != http.StatusBadGateway || w.Body.String() != dnssecUncheckedError+"\n" {
+		t.Errorf("status %d, body %s; want the unchecked 502", w.Code, w.Body)
+	}
+}
+
+func TestAllConcurrent(t *testing.T) {
+	useTransports(t, "tcp,tls")
+	s := useFixtures(t,
+		srvFixture("_xmpp-client._tcp.example.test", 0, 0, 5222, "xmpp.example.test"),
+		srvFixture("_xmpps-client._tcp.example.test", 0, 0, 5223, "xmpp.example.test"),
+		srvFixture("_xmpp-server._tcp.example.test", 0, 0, 5269, "xmpp.example.test"),
+		srvFixture("_xmpps-server._tcp.example.test", 0, 0, 5270, "xmpp.example.test"),
+		txtFixture("_xmppconnect.example.test", 60, "_xmpp-client-websocket=wss://xmpp.example.test/ws"),
+	)
+
+	// Enough slots for the four SRV lookups and the TXT one at once.
+	saved := maxRequestLookups
+	maxRequestLookups = 5
+	defer func() { maxRequestLookups = saved }()
+
+	const delay = 300 * time.Millisecond
+	s.delayReplies(delay)
+
+	start := time.Now()
+	data := getData(t, "/example.test?type=all")
+	elapsed := time.Since(start)
+
+	if len(data.Servers) != 2 || len(data.S2SServers) != 2 || len(data.Alternatives) != 1 {
+		t.Errorf("data = %+v, want every record", data)
+	}
+
+	if elapsed >= 2*delay-50*time.Millisecond {
+		t.Errorf("took %v, want the lookups made together", elapsed)
+	}
+
+	// Under a shared deadline shorter than any reply, every lookup gives
+	// up at once rather than one after the other.
+	savedDeadline := lookupDeadline
+	lookupDeadline = delay / 3
+	defer func() { lookupDeadline = savedDeadline }()
+
+	start = time.Now()
+	w := get(t, "/example.test?type=all")
+	elapsed = time.Since(start)
+
+	if w.Code < 500 || elapsed >= delay {
+		t.Errorf("status %d after %v, want a failure within the deadline", w.Code, elapsed)
+	}
+}
@@ -0,0 +1,182 @@
+// Copyright 2015 Michael Johnson. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// reverseIndex maps server targets to the domains whose SRV records were
+// last seen pointing at them, so that operators of shared infrastructure can
+// ask which domains use a host. DNS can't answer that, so the index only
+// knows the domains this instance has resolved, including any it prewarmed,
+// since it started. It is not exhaustive.
+type reverseIndex struct {
+	mu         sync.Mutex
+	maxDomains int
+
+	// byDomain are the targets each domain was last seen with for each
+	// role, and byTarget the domains and roles seen with each target and
+	// when.
+	byDomain map[reverseKey][]string
+	byTarget map[string]map[reverseKey]time.Time
+
+	// domains counts the domains in byDomain, whatever their roles.
+	domains map[string]int
+}
+
+type reverseKey struct {
+	domain, role string
+}
+
+// reverseTargets is nil if -reverse-index-size is 0.
+var reverseTargets *reverseIndex
+
+func newReverseIndex(maxDomains int) *reverseIndex {
+	return &reverseIndex{
+		maxDomains: maxDomains,
+		byDomain:   make(map[reverseKey][]string),
+		byTarget:   make(map[string]map[reverseKey]time.Time),
+		domains:    make(map[string]int),
+	}
+}
+
+func normalizeHost(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+// record replaces the targets of domain for each of the roles of transports,
+// which were looked up, with those of its servers found in SRV records. Once
+// the index is full, new domains are left out rather than evicting others.
+func (x *reverseIndex) record(domain string, transports []*transport, servers serverList) {
+	if x == nil {
+		return
+	}
+
+	domain = normalizeHost(domain)
+
+	targets := make(map[string][]string)
+	for _, t := range transports {
+		targets[t.role] = nil
+	}
+
+	for _, s := range servers {
+		if s.Source == sourceSRV {
+			targets[s.via.role] = append(targets[s.via.role], normalizeHost(s.Target))
+		}
+	}
+
+	now := time.Now()
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	for role, roleTargets := range targets {
+		key := reverseKey{domain, role}
+
+		old, known := x.byDomain[key]
+		if !known && (len(roleTargets) == 0 || x.domains[domain] == 0 && len(x.domains) >= x.maxDomains) {
+			continue
+		}
+
+		for _, target := range old {
+			delete(x.byTarget[target], key)
+			if len(x.byTarget[target]) == 0 {
+				delete(x.byTarget, target)
+			}
+		}
+
+		if len(roleTargets) == 0 {
+			delete(x.byDomain, key)
+			if x.domains[domain]--; x.domains[domain] == 0 {
+				delete(x.domains, domain)
+			}
+			continue
+		}
+
+		if !known {
+			x.domains[domain]++
+		}
+
+		x.byDomain[key] = roleTargets
+		for _, target := range roleTargets {
+			if x.byTarget[target] == nil {
+				x.byTarget[target] = make(map[reverseKey]time.Time)
+			}
+			x.byTarget[target][key] = now
+		}
+	}
+}
+
+type reverseDomain struct {
+	Domain string    `json:"domain"`
+	Role   string    `json:"role"`
+	Seen   time.Time `json:"seen"`
+}
+
+// lookup returns the domains last seen with target, most recently seen first.
+func (x *reverseIndex) lookup(target string) []*reverseDomain {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	domains := make([]*reverseDomain, 0, len(x.byTarget[normalizeHost(target)]))
+	for key, seen := range x.byTarget[normalizeHost(target)] {
+		domains = append(domains, &reverseDomain{key.domain, key.role, seen})
+	}
+
+	sort.Slice(domains, func(i, j int) bool {
+		if !domains[i].Seen.Equal(domains[j].Seen) {
+			return domains[i].Seen.After(domains[j].Seen)
+		}
+
+		if domains[i].Domain != domains[j].Domain {
+			return domains[i].Domain < domains[j].Domain
+		}
+
+		return domains[i].Role < domains[j].Role
+	})
+
+	return domains
+}
+
+// serveReverse reports to admins which of the domains in the reverse index
+// have SRV records targeting the host given by the target parameter.
+// Revealing which domains have been looked up is a privacy concern, hence
+// the restriction.
+func serveReverse(w http.ResponseWriter, r *http.Request) {
+	h := w.Header()
+	h.Set("Content-Type", "application/json; charset=utf-8")
+	h.Set("Cache-Control", "private, no-store")
+
+	if !isAdmin(r) {
+		httpError(w, adminOnlyError, http.StatusForbidden)
+		return
+	}
+
+	if reverseTargets == nil {
+		httpError(w, errorJSON(http.StatusNotFound, "The reverse index is disabled."), http.StatusNotFound)
+		return
+	}
+
+	target := r.URL.Query().Get("target")
+	if !isDomainName(target) || target == "." {
+		httpError(w, errorJSON(http.StatusBadRequest, fmt.Sprintf("Invalid value %q for the target parameter; expected a hostname.", target)), http.StatusBadRequest)
+		return
+	}
+
+	fmt.Fprintln(w, mustJSONEncode(&struct {
+		Version string `json:"apiVersion"`
+		Data    any    `json:"data"`
+	}{apiVersion, &struct {
+		Target     string           `json:"target"`
+		Domains    []*reverseDomain `json:"domains"`
+		Exhaustive bool             `json:"exhaustive"`
+	}{normalizeHost(target), reverseTargets.lookup(target), false}}))
+}
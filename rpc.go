@@ -0,0 +1,291 @@
+// Copyright 2015 Michael Johnson. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// JSON-RPC 2.0 error codes. Errors resolving a domain use rpcResolveError,
+// with the body its URL would have returned as the data.
+const (
+	rpcParseError     = -32700
+	rpcInvalidRequest = -32600
+	rpcMethodNotFound = -32601
+	rpcInvalidParams  = -32602
+	rpcResolveError   = -32000
+)
+
+// maxRPCBodySize is the largest request body accepted by /rpc. Requests
+// carry their own options, so it allows more per domain than a batch.
+func maxRPCBodySize() int64 {
+	return int64(maxBatchSize)*1024 + 16
+}
+
+type rpcRequest struct {
+	Version string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params"`
+	ID      json.RawMessage `json:"id"`
+}
+
+// rpcParams are the parameters of the resolve method. Options takes the same
+// names and values as the query string, with booleans and numbers allowed in
+// place of strings.
+type rpcParams struct {
+	Domain  string                     `json:"domain"`
+	Options map[string]json.RawMessage `json:"options"`
+}
+
+type rpcResponse struct {
+	Version string          `json:"jsonrpc"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+	ID      json.RawMessage `json:"id"`
+
+	// query holds the options of the call, to warn about deprecated ones.
+	query url.Values
+}
+
+type rpcError struct {
+	Code    int             `json:"code"`
+	Message string          `json:"message"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+func rpcErrorResponse(id json.RawMessage, code int, message string) *rpcResponse {
+	return &rpcResponse{Version: "2.0", Error: &rpcError{Code: code, Message: message}, ID: id}
+}
+
+// rpcNullID is the id of responses to requests whose id couldn't be read.
+var rpcNullID = json.RawMessage("null")
+
+// serveRPC answers JSON-RPC 2.0 requests, singly or in a batch, POSTed to
+// it. The only method, resolve, takes a domain and its own options, so unlike
+// /batch each domain in a batch can be resolved differently.
+func serveRPC(w http.ResponseWriter, r *http.Request) {
+	if servePreflight(w, r, "POST") {
+		return
+	}
+
+	if r.Method != "POST" {
+		http.Error(w, fmt.Sprintf("This resource does not accept %s requests.", r.Method), http.StatusMethodNotAllowed)
+		return
+	}
+
+	h := w.Header()
+	h.Set("Content-Type", "application/json; charset=utf-8")
+	allowCrossOrigin(h)
+
+	limit := maxRPCBodySize()
+	if r.ContentLength > limit {
+		httpError(w, batchTooLargeError(), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	var body json.RawMessage
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, limit)).Decode(&body); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			httpError(w, batchTooLargeError(), http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		fmt.Fprintln(w, mustJSONEncode(rpcErrorResponse(rpcNullID, rpcParseError, "Parse error")))
+		return
+	}
+
+	// A batch is an array of requests; anything else is a single request.
+	body = bytes.TrimSpace(body)
+	if len(body) == 0 || body[0] != '[' {
+		if res := handleRPC(r, body); res != nil {
+			warnDeprecated(h, res.query)
+			fmt.Fprintln(w, mustJSONEncode(res))
+		} else {
+			w.WriteHeader(http.StatusNoContent)
+		}
+
+		return
+	}
+
+	var batch []json.RawMessage
+	if err := json.Unmarshal(body, &batch); err != nil || len(batch) == 0 {
+		fmt.Fprintln(w, mustJSONEncode(rpcErrorResponse(rpcNullID, rpcInvalidRequest, "Invalid Request")))
+		return
+	}
+
+	if len(batch) > maxBatchSize {
+		httpError(w, batchTooLargeError(), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	var (
+		responses = make([]*rpcResponse, len(batch))
+		slots     = make(chan struct{}, batchConcurrency)
+		wg        sync.WaitGroup
+	)
+
+	for i, req := range batch {
+		wg.Add(1)
+		go func(i int, req json.RawMessage) {
+			defer wg.Done()
+
+			slots <- struct{}{}
+			defer func() { <-slots }()
+
+			responses[i] = handleRPC(r, req)
+		}(i, req)
+	}
+	wg.Wait()
+
+	// Notifications get no response, and a batch of only notifications
+	// gets nothing at all.
+	out := responses[:0]
+	query := make(url.Values)
+	for _, res := range responses {
+		if res != nil {
+			out = append(out, res)
+			for name, values := range res.query {
+				query[name] = append(query[name], values...)
+			}
+		}
+	}
+	warnDeprecated(h, query)
+
+	if len(out) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	fmt.Fprintln(w, mustJSONEncode(out))
+}
+
+// handleRPC answers a single JSON-RPC request, returning nil if it is a
+// notification.
+func handleRPC(r *http.Request, raw json.RawMessage) *rpcResponse {
+	var req rpcRequest
+	if err := json.Unmarshal(raw, &req); err != nil || req.Version != "2.0" || req.Method == "" || !validRPCID(req.ID) {
+		return rpcErrorResponse(rpcNullID, rpcInvalidRequest, "Invalid Request")
+	}
+
+	notification := req.ID == nil
+	id := req.ID
+
+	res := callRPC(r, &req)
+	if notification {
+		return nil
+	}
+
+	res.ID = id
+	return res
+}
+
+// validRPCID reports whether id is absent or a string, number or null, as
+// JSON-RPC requires.
+func validRPCID(id json.RawMessage) bool {
+	if id == nil {
+		return true
+	}
+
+	switch id[0] {
+	case '"', 'n', '-', '0', '1', '2', '3', '4', '5', '6', '7', '8', '9':
+		return true
+	}
+
+	return false
+}
+
+// callRPC runs the method of req.
+func callRPC(r *http.Request, req *rpcRequest) *rpcResponse {
+	if req.Method != "resolve" {
+		return rpcErrorResponse(nil, rpcMethodNotFound, "Method not found")
+	}
+
+	var params rpcParams
+	if err := json.Unmarshal(req.Params, &params); err != nil || params.Domain == "" {
+		return rpcErrorResponse(nil, rpcInvalidParams, "Invalid params: expected an object with a domain and optional options.")
+	}
+
+	query, err := rpcQuery(params.Options)
+	if err != nil {
+		return rpcErrorResponse(nil, rpcInvalidParams, "Invalid params: "+err.Error())
+	}
+
+	res := resolveRPC(r, params.Domain, query)
+	res.query = query
+	return res
+}
+
+// resolveRPC resolves domain with the options in query for callRPC.
+func resolveRPC(r *http.Request, domain string, query url.Values) *rpcResponse {
+	opts, rerr := requestOptions(r, query)
+	if rerr != nil {
+		return rpcResolveErrorResponse(rerr)
+	}
+
+	// Results are embedded in the JSON-RPC response, so can't be MessagePack.
+	opts.format = jsonFormat
+
+	domainRequests.observe(strings.ToLower(domain))
+
+	entry, _, rerr := cachedResponse(opts.context(r.Context()), domain, opts)
+	if rerr != nil {
+		return rpcResolveErrorResponse(rerr)
+	}
+
+	return &rpcResponse{Version: "2.0", Result: entry.Body}
+}
+
+// rpcResolveErrorResponse returns the JSON-RPC error for rerr, with the
+// error's message and the body the request's URL would have returned. Invalid
+// options are invalid params.
+func rpcResolveErrorResponse(rerr *requestError) *rpcResponse {
+	code, message := rpcResolveError, http.StatusText(rerr.code)
+	if rerr.code == http.StatusBadRequest {
+		code = rpcInvalidParams
+	}
+
+	var resp response
+	if json.Unmarshal([]byte(rerr.body), &resp) == nil && resp.Error != nil {
+		message = resp.Error.Message
+	}
+
+	res := rpcErrorResponse(nil, code, message)
+	res.Error.Data = json.RawMessage(rerr.body)
+	return res
+}
+
+// rpcQuery converts JSON-RPC options to the query parameters they stand for.
+func rpcQuery(options map[string]json.RawMessage) (url.Values, error) {
+	query := make(url.Values, len(options))
+
+	for name, raw := range options {
+		var value any
+		if err := json.Unmarshal(raw, &value); err != nil {
+			return nil, err
+		}
+
+		switch v := value.(type) {
+		case string:
+			query.Set(name, v)
+		case bool:
+			query.Set(name, strconv.FormatBool(v))
+		case float64:
+			query.Set(name, strconv.FormatFloat(v, 'f', -1, 64))
+		default:
+			return nil, fmt.Errorf("option %q must be a string, boolean or number.", name)
+		}
+	}
+
+	return query, nil
+}
@@ -0,0 +1,106 @@
+// Copyright 2015 Michael Johnson. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// rttTimeout bounds each connection timed by order=rtt. Servers that
+	// take longer are treated as unreachable.
+	rttTimeout = 2 * time.Second
+
+	// rttConcurrency is the number of servers in a response timed at once.
+	rttConcurrency = 8
+)
+
+// Orders for the order parameter.
+const (
+	orderPriority = "priority"
+	orderRTT      = "rtt"
+)
+
+// orderByRTT times a TCP connection to each server in data and reorders the
+// servers fastest first. Unreachable servers, and those not over TCP, follow
+// in their priority and weight order.
+//
+// This is experimental: a connection from here says little about the
+// latency a client elsewhere will see.
+func orderByRTT(ctx context.Context, data *responseData) {
+	r, _ := resolversFor(ctx)
+	d := outboundDialer(r)
+
+	var (
+		slots = make(chan struct{}, rttConcurrency)
+		wg    sync.WaitGroup
+	)
+
+	for _, s := range data.allServers() {
+		if t := s.via; t == nil || t.proto != "tcp" || s.Port == 0 {
+			continue
+		}
+
+		wg.Add(1)
+		go func(s *server) {
+			defer wg.Done()
+
+			slots <- struct{}{}
+			defer func() { <-slots }()
+
+			ctx, cancel := context.WithTimeout(ctx, rttTimeout)
+			defer cancel()
+
+			// Only the connection is timed, not looking up the target.
+			addrs, err := r.LookupHost(ctx, strings.TrimSuffix(s.Target, "."))
+			if err != nil {
+				return
+			}
+
+			for _, addr := range addrs {
+				start := time.Now()
+				conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort(addr, strconv.Itoa(int(s.Port))))
+				if err != nil {
+					continue
+				}
+				conn.Close()
+
+				s.RTT = max(float64(time.Since(start).Microseconds())/1000, 0.001)
+				return
+			}
+		}(s)
+	}
+
+	wg.Wait()
+
+	data.Servers.sortByRTT()
+	data.S2SServers.sortByRTT()
+}
+
+// sortByRTT sorts s by measured RTT, keeping the existing order of servers
+// without one at the end.
+func (s serverList) sortByRTT() {
+	sort.SliceStable(s, func(i, j int) bool {
+		a, b := s[i], s[j]
+		if a.RTT == 0 || b.RTT == 0 {
+			return a.RTT != 0 && b.RTT == 0
+		}
+
+		return a.RTT < b.RTT
+	})
+}
+
+// rankAsListed ranks s in the order it is in.
+func (s serverList) rankAsListed() {
+	for i, srv := range s {
+		srv.Rank = i + 1
+	}
+}
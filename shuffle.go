@@ -0,0 +1,188 @@
+// Copyright 2015 Michael Johnson. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"log"
+	"math/rand"
+	"net/http"
+	"sort"
+)
+
+// maxClientKeyLength bounds client-key, which is only hashed.
+const maxClientKeyLength = 256
+
+// shuffle reorders s the way RFC 2782 says clients should pick servers: by
+// ascending priority and, within a priority, by repeated weighted random
+// selection, with servers of weight 0 having a small chance of being picked
+// before the others. The random numbers are taken from intn.
+func (s serverList) shuffle(intn func(n int) int) {
+	sort.SliceStable(s, func(i, j int) bool {
+		return s[i].Priority < s[j].Priority
+	})
+
+	for start := 0; start < len(s); {
+		end := start + 1
+		for end < len(s) && s[end].Priority == s[start].Priority {
+			end++
+		}
+
+		group := s[start:end]
+
+		// Weight 0 servers go first, so that a running sum landing on
+		// 0 picks them.
+		sort.SliceStable(group, func(i, j int) bool {
+			return group[i].Weight == 0 && group[j].Weight != 0
+		})
+
+		for i := range group {
+			total := 0
+			for _, srv := range group[i:] {
+				total += int(srv.Weight)
+			}
+
+			pick, sum := intn(total+1), 0
+			for j := i; j < len(group); j++ {
+				sum += int(group[j].Weight)
+				if sum >= pick {
+					// Shifting rather than swapping keeps those
+					// left with weight 0 first.
+					picked := group[j]
+					copy(group[i+1:j+1], group[i:j])
+					group[i] = picked
+					break
+				}
+			}
+		}
+
+		start = end
+	}
+}
+
+// shuffleFor shuffles s using random numbers seeded from a client's key, so
+// that the key always gets the same order for the same records while
+// different keys are spread across the servers as shuffle spreads requests.
+// s is first put in a canonical order, as the records may be returned in any
+// order. Any change to the records can change every key's order, so the
+// order is only ever advisory.
+func (s serverList) shuffleFor(key string) {
+	sort.SliceStable(s, func(i, j int) bool {
+		a, b := s[i], s[j]
+		switch {
+		case a.Priority != b.Priority:
+			return a.Priority < b.Priority
+		case a.Target != b.Target:
+			return a.Target < b.Target
+		case a.Port != b.Port:
+			return a.Port < b.Port
+		}
+		return a.Transport < b.Transport
+	})
+
+	sum := sha256.Sum256([]byte(key))
+	s.shuffle(rand.New(rand.NewSource(int64(binary.BigEndian.Uint64(sum[:])))).Intn)
+}
+
+// restoreTransports sets the transport of each server in data decoded from
+// the cache, which isn't encoded, from its role and transport label, so that
+// config snippets and the like can be written from it.
+func (data *responseData) restoreTransports(serviceType string) {
+	role := roleClient
+	if serviceType == typeServer {
+		role = roleServer
+	}
+
+	for _, s := range data.Servers {
+		if s.Role != "" {
+			s.via = transportFor(s.Role, s.Transport)
+		} else {
+			s.via = transportFor(role, s.Transport)
+		}
+	}
+
+	for _, s := range data.S2SServers {
+		s.via = transportFor(roleServer, s.Transport)
+	}
+}
+
+// shuffledResponse returns the response for domain with its servers freshly
+// shuffled for shuffle=true. The cache holds the records unshuffled, as
+// JSON with every field, so each request gets its own order without the
+// domain being resolved again. The response's ETag is that of its own body,
+// so differently shuffled responses have different ETags. With client-key,
+// the order is the key's own rather than fresh.
+func shuffledResponse(ctx context.Context, domain string, opts *options, key string) (*cacheEntry, bool, *requestError) {
+	stored := responseCache.get(key)
+	hit := stored != nil
+
+	if stored == nil {
+		data, rerr := resolveSearch(ctx, domain, opts)
+		if rerr != nil {
+			return nil, false, rerr
+		}
+
+		encoded, err := json.Marshal(data)
+		if err != nil {
+			log.Fatalf("Error marshalling records for %q: %v", domain, err)
+		}
+
+		stored = newCacheEntry(encoded, data)
+		responseCache.set(key, stored, stored.ttl())
+	}
+
+	var data responseData
+	if err := json.Unmarshal(stored.Body, &data); err != nil {
+		log.Printf("Error unmarshalling cached records for %q: %v", domain, err)
+		return nil, false, &requestError{http.StatusInternalServerError, internalServerError}
+	}
+
+	data.domain = domain
+	if data.Domain != "" {
+		data.domain = data.Domain
+	}
+	data.restoreTransports(opts.serviceType)
+
+	// The roles of type=both are shuffled separately, as their weights
+	// aren't comparable.
+	clients, s2s := data.Servers, data.S2SServers
+	if opts.serviceType == typeBoth {
+		clients, s2s = data.Servers.splitRoles()
+	}
+
+	if opts.clientKey != "" {
+		clients.shuffleFor(opts.clientKey)
+		s2s.shuffleFor(opts.clientKey)
+	} else {
+		clients.shuffle(rand.Intn)
+		s2s.shuffle(rand.Intn)
+	}
+
+	if opts.rank {
+		clients.rankAsListed()
+		s2s.rankAsListed()
+	}
+
+	if opts.serviceType == typeBoth {
+		data.Servers = withRoles(clients, s2s, false)
+	}
+
+	encoded, err := encodeResponse(&data, opts)
+	if err != nil {
+		log.Fatalf("Error marshalling %s for %q: %v", opts.responseFormat().name, domain, err)
+	}
+
+	return &cacheEntry{
+		Body:             encoded,
+		ETag:             etagFor(encoded),
+		Expires:          stored.Expires,
+		Resolved:         stored.Resolved,
+		Signature:        stored.Signature,
+		NonAuthoritative: stored.NonAuthoritative,
+	}, hit, nil
+}
@@ -0,0 +1,21 @@
+// Copyright 2015 Michael Johnson. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestShuffledConfig(t *testing.T) {
+	useFixtures(t, srvFixture("_xmpp-client._tcp.example.test", 0, 0, 5222, "xmpp.example.test"))
+
+	for _, query := range []string{"shuffle=true", "client-key=alice"} {
+		w := get(t, "/example.test?format=config&client=smack&"+query)
+		if body := w.Body.String(); !strings.Contains(body, `.setHost("xmpp.example.test")`) {
+			t.Errorf("%s: config is\n%s\nwant the STARTTLS server", query, body)
+		}
+	}
+}
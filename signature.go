@@ -0,0 +1,105 @@
+// Copyright 2015 Michael Johnson. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// signatureKey, if set, is used to sign the records of each response, so
+// that clients sharing the key can check they weren't altered by a cache
+// along the way.
+var signatureKey []byte
+
+// signatureHeader carries the signature of a response's records.
+const signatureHeader = "X-Records-Signature"
+
+// readSignatureKey reads the key from the file name, ignoring surrounding
+// whitespace.
+func readSignatureKey(name string) ([]byte, error) {
+	key, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return bytes.TrimSpace(key), nil
+}
+
+// signRecords returns the signature of the records in data for the
+// X-Records-Signature header, or "" if signing is disabled. It is
+// "hmac-sha256=" followed by the base64 HMAC-SHA256 of the canonical form
+// of the records, which is the same whatever the format and options:
+//
+//	xmppresolv-records-v1
+//	domain <domain>
+//
+// followed by a line for each record, sorted bytewise:
+//
+//	server <target> <port> <priority> <weight> <transport>
+//	s2s-server <target> <port> <priority> <weight> <transport>
+//	alternative <name> <value>
+//
+// Each line ends with a newline. The domain is the one requested, or the
+// response's domain field if a search domain was appended. It and the targets
+// are lowercase with no trailing dot, and the transport is tcp when a server
+// has none. Servers are those in servers, s2s-servers those in s2sServers or,
+// with type=both, those in servers with the role server.
+// Fields added by options, such as addresses, findings and ranks, and
+// capabilities aren't signed.
+func signRecords(data *responseData) string {
+	if len(signatureKey) == 0 {
+		return ""
+	}
+
+	name := func(s string) string {
+		return strings.ToLower(strings.TrimSuffix(s, "."))
+	}
+
+	var lines []string
+	addServers := func(kind string, servers serverList) {
+		for _, s := range servers {
+			kind := kind
+			if s.Role == roleServer {
+				kind = "s2s-server"
+			}
+
+			transport := s.Transport
+			if transport == "" {
+				transport = "tcp"
+			}
+
+			lines = append(lines, strings.Join([]string{
+				kind,
+				name(s.Target),
+				strconv.Itoa(int(s.Port)),
+				strconv.Itoa(int(s.Priority)),
+				strconv.Itoa(int(s.Weight)),
+				transport,
+			}, " "))
+		}
+	}
+
+	addServers("server", data.Servers)
+	addServers("s2s-server", data.S2SServers)
+	for _, a := range data.Alternatives {
+		lines = append(lines, "alternative "+a.Name+" "+a.Value)
+	}
+	sort.Strings(lines)
+
+	mac := hmac.New(sha256.New, signatureKey)
+	mac.Write([]byte("xmppresolv-records-v1\ndomain " + name(data.domain) + "\n"))
+	for _, line := range lines {
+		mac.Write([]byte(line + "\n"))
+	}
+
+	return "hmac-sha256=" + base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,67 @@
+// Copyright 2015 Michael Johnson. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+)
+
+var (
+	// ssrfProtection stops features that connect to the hosts a domain's
+	// records name from connecting to internal addresses, so that a
+	// malicious domain can't make this service reach into its own network.
+	ssrfProtection = true
+
+	// filterInternalAddresses removes internal addresses from those
+	// returned by resolve=true.
+	filterInternalAddresses bool
+
+	// trustedNetworks are internal networks that may be connected to and
+	// returned regardless.
+	trustedNetworks []*net.IPNet
+)
+
+// sharedAddressSpace is the carrier-grade NAT range of RFC 6598, which
+// net.IP doesn't consider private but is just as internal.
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// isInternal reports whether ip is a loopback, private, link-local or other
+// address that shouldn't be reachable from a public service, and isn't in
+// -trusted-networks.
+func isInternal(ip net.IP) bool {
+	internal := ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() ||
+		ip.IsMulticast() || sharedAddressSpace.Contains(ip) || (ip.To4() != nil && ip.To4()[0] == 0)
+
+	return internal && !containsIP(trustedNetworks, ip)
+}
+
+// outboundDialer returns a dialer for connecting to hosts named by a domain's
+// records, resolving them with r. With -ssrf-protection the address is
+// checked after resolution, just before connecting, so that a name can't
+// resolve to a public address when checked and an internal one when used.
+func outboundDialer(r *net.Resolver) *net.Dialer {
+	d := &net.Dialer{Resolver: r}
+	if !ssrfProtection {
+		return d
+	}
+
+	d.Control = func(network, address string, _ syscall.RawConn) error {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return err
+		}
+
+		if ip := net.ParseIP(host); ip == nil || isInternal(ip) {
+			return fmt.Errorf("refusing to connect to internal address %s", host)
+		}
+
+		return nil
+	}
+
+	return d
+}
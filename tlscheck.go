@@ -0,0 +1,81 @@
+// Copyright 2015 Michael Johnson. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// tlsCheckTimeout bounds each connection made to check a certificate,
+// including the handshake.
+var tlsCheckTimeout = 5 * time.Second
+
+// checkTLS connects to each direct TLS server in data and adds a finding
+// saying whether the certificate it presents is valid for domain. Per
+// XEP-0368 the certificate must match the source domain rather than the SRV
+// target, and the xmpp-client or xmpp-server ALPN protocol is offered.
+//
+// Only DNS-IDs are checked, as that is what crypto/tls verifies; SRV-IDs and
+// XmppAddr identifiers from RFC 6120 are not recognised.
+func checkTLS(ctx context.Context, domain string, data *responseData) {
+	domain = strings.TrimSuffix(domain, ".")
+	r, _ := resolversFor(ctx)
+
+	var servers serverList
+	for _, s := range data.allServers() {
+		if t := s.via; t != nil && t.directTLS && t.proto == "tcp" && s.Port != 0 {
+			servers = append(servers, s)
+		}
+	}
+
+	data.addFindingsConcurrently(servers, func(s *server) []*finding {
+		return []*finding{checkCertificate(ctx, r, domain, s)}
+	})
+}
+
+func checkCertificate(ctx context.Context, r *net.Resolver, domain string, s *server) *finding {
+	endpoint := net.JoinHostPort(strings.TrimSuffix(s.Target, "."), strconv.Itoa(int(s.Port)))
+
+	ctx, cancel := context.WithTimeout(ctx, tlsCheckTimeout)
+	defer cancel()
+
+	d := &tls.Dialer{
+		NetDialer: outboundDialer(r),
+		Config: &tls.Config{
+			ServerName: domain,
+			NextProtos: []string{"xmpp-" + s.via.role},
+		},
+	}
+
+	conn, err := d.DialContext(ctx, "tcp", endpoint)
+	if err == nil {
+		conn.Close()
+		return &finding{severityInfo, endpoint, fmt.Sprintf("The TLS certificate is valid for %s.", domain)}
+	}
+
+	var (
+		hostnameErr  x509.HostnameError
+		authorityErr x509.UnknownAuthorityError
+		invalidErr   x509.CertificateInvalidError
+		verifyErr    *tls.CertificateVerificationError
+	)
+
+	switch {
+	case errors.As(err, &hostnameErr):
+		return &finding{severityWarning, endpoint, fmt.Sprintf("The TLS certificate is not valid for %s: %v.", domain, hostnameErr)}
+	case errors.As(err, &authorityErr), errors.As(err, &invalidErr), errors.As(err, &verifyErr):
+		return &finding{severityWarning, endpoint, fmt.Sprintf("The TLS certificate could not be verified: %v.", err)}
+	default:
+		return &finding{severityWarning, endpoint, fmt.Sprintf("The TLS certificate could not be checked: %v.", err)}
+	}
+}
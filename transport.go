@@ -0,0 +1,208 @@
+// Copyright 2015 Michael Johnson. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// transport describes an SRV label under which client or server endpoints
+// may be published.
+type transport struct {
+	name    string
+	service string
+	proto   string
+
+	// role is roleClient for client-to-server endpoints and roleServer
+	// for server-to-server ones.
+	role string
+
+	// label is reported in the transport field of each server found under
+	// this transport. It is empty for plain TCP so that the default
+	// response is unchanged.
+	label string
+
+	// defaultPort is the port registered for the service, if there is one.
+	defaultPort uint16
+
+	// directTLS is set when TLS is negotiated immediately on connecting,
+	// rather than with STARTTLS.
+	directTLS bool
+
+	// experimental transports track drafts that may still change and must
+	// be enabled explicitly with -experimental.
+	experimental bool
+}
+
+const (
+	roleClient = "client"
+	roleServer = "server"
+)
+
+var knownTransports = []*transport{
+	{name: "tcp", service: "xmpp-client", proto: "tcp", role: roleClient, defaultPort: 5222},
+	// XEP-0368
+	{name: "tls", service: "xmpps-client", proto: "tcp", role: roleClient, label: "tls", directTLS: true},
+	// There is no registered SRV label for XMPP over QUIC yet; this follows
+	// the most common proposal and will change if a different one is
+	// adopted.
+	{name: "quic", service: "xmpp-client", proto: "udp", role: roleClient, label: "quic", directTLS: true, experimental: true},
+}
+
+// serverTransports are the server-to-server counterparts of knownTransports,
+// by the same names. There is no proposal for QUIC between servers.
+var serverTransports = []*transport{
+	{name: "tcp", service: "xmpp-server", proto: "tcp", role: roleServer, defaultPort: 5269},
+	{name: "tls", service: "xmpps-server", proto: "tcp", role: roleServer, label: "tls", directTLS: true},
+}
+
+// enabledTransports are the client transports queried for each request, set
+// from the -transports flag.
+var enabledTransports = knownTransports[:1]
+
+// enabledServerTransports returns the server transports with the same names
+// as the enabled client transports.
+func enabledServerTransports() []*transport {
+	var out []*transport
+	for _, t := range serverTransports {
+		for _, enabled := range enabledTransports {
+			if t.name == enabled.name {
+				out = append(out, t)
+			}
+		}
+	}
+
+	return out
+}
+
+// transportFor returns the transport of role whose servers are reported
+// with label, or nil if there is none.
+func transportFor(role, label string) *transport {
+	list := knownTransports
+	if role == roleServer {
+		list = serverTransports
+	}
+
+	for _, t := range list {
+		if t.label == label {
+			return t
+		}
+	}
+
+	return nil
+}
+
+func parseTransports(list string, experimental bool) ([]*transport, error) {
+	var out []*transport
+
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+
+		var found *transport
+		for _, t := range knownTransports {
+			if t.name == name {
+				found = t
+				break
+			}
+		}
+
+		if found == nil {
+			return nil, fmt.Errorf("unknown transport %q", name)
+		}
+
+		if found.experimental && !experimental {
+			return nil, fmt.Errorf("transport %q is experimental and requires -experimental", name)
+		}
+
+		out = append(out, found)
+	}
+
+	if len(out) == 0 {
+		return nil, fmt.Errorf("no transports enabled")
+	}
+
+	return out, nil
+}
+
+// scheme returns the prefix of the SRV service, xmpp or xmpps, which says
+// whether TLS is negotiated with STARTTLS or immediately.
+func (t *transport) scheme() string {
+	prefix, _, _ := strings.Cut(t.service, "-")
+	return prefix
+}
+
+// advice tells clients how a connection to a server should be secured.
+type advice struct {
+	DirectTLS       bool `json:"directTls"`
+	RequireTLS      bool `json:"requireTls"`
+	InsecureAllowed bool `json:"insecureAllowed"`
+}
+
+func (t *transport) advice() *advice {
+	// RFC 7590 requires TLS for every transport; the only difference is
+	// whether it is negotiated with STARTTLS or immediately.
+	return &advice{
+		DirectTLS:       t.directTLS,
+		RequireTLS:      true,
+		InsecureAllowed: false,
+	}
+}
+
+// recommendation is the server a client should connect to, for
+// recommended=true, so that thin clients needn't choose between transports
+// themselves.
+type recommendation struct {
+	Target    string `json:"target"`
+	Port      uint16 `json:"port"`
+	Transport string `json:"transport,omitempty"`
+	Scheme    string `json:"scheme"`
+	DirectTLS bool   `json:"directTls"`
+	Reason    string `json:"reason"`
+}
+
+// recommend returns the client server to connect to from servers, which are
+// in the order to try them: the first direct TLS one, as negotiating TLS
+// immediately leaves nothing in the clear for an attacker to strip or
+// tamper with (XEP-0368), or failing that the first STARTTLS one.
+// Experimental transports are never recommended. It returns nil if there is
+// no server to recommend.
+func recommend(servers serverList) *recommendation {
+	var starttls *server
+	for _, s := range servers {
+		t := s.via
+		if t == nil || t.role != roleClient || t.experimental || s.Port == 0 {
+			continue
+		}
+
+		if t.directTLS {
+			return newRecommendation(s, "Direct TLS is available, which is preferred to STARTTLS.")
+		}
+
+		if starttls == nil {
+			starttls = s
+		}
+	}
+
+	if starttls == nil {
+		return nil
+	}
+
+	return newRecommendation(starttls, "Only STARTTLS is available; TLS must still be required.")
+}
+
+func newRecommendation(s *server, reason string) *recommendation {
+	return &recommendation{
+		Target:    s.Target,
+		Port:      s.Port,
+		Transport: s.Transport,
+		Scheme:    s.via.scheme(),
+		DirectTLS: s.via.directTLS,
+		Reason:    reason,
+	}
+}
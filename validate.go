@@ -0,0 +1,90 @@
+// Copyright 2015 Michael Johnson. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+)
+
+// finding is an advisory note about a domain's configuration, reported in
+// validate mode. None of them stop the records from being usable.
+type finding struct {
+	Severity string `json:"severity"`
+	Target   string `json:"target,omitempty"`
+	Message  string `json:"message"`
+}
+
+const (
+	severityInfo    = "info"
+	severityWarning = "warning"
+)
+
+// validate annotates data with findings about its servers and alternatives.
+func validate(data *responseData) {
+	for _, a := range data.Alternatives {
+		host := a.host()
+		if host == "" || (net.ParseIP(host) == nil && !isDomainName(host)) {
+			data.addFinding(severityWarning, a.Value, fmt.Sprintf("The %s alternative is not a URL with a valid host.", a.Name))
+		}
+	}
+
+	for _, s := range data.allServers() {
+		t := s.via
+		endpoint := fmt.Sprintf("%s:%d", strings.TrimSuffix(s.Target, "."), s.Port)
+
+		switch {
+		case s.Port == 0:
+			data.addFinding(severityWarning, endpoint, "Port 0 cannot be connected to.")
+		case t != nil && t.defaultPort != 0 && s.Port == t.defaultPort:
+			s.StandardPort = true
+		case t != nil && t.defaultPort != 0:
+			data.addFinding(severityInfo, endpoint, fmt.Sprintf("Non-standard port; the default for this service is %d.", t.defaultPort))
+		}
+	}
+}
+
+func (data *responseData) addFinding(severity, target, message string) {
+	data.Findings = append(data.Findings, &finding{
+		Severity: severity,
+		Target:   target,
+		Message:  message,
+	})
+}
+
+// maxConcurrentChecks caps the number of servers a request checks at once,
+// as each check opens a connection.
+const maxConcurrentChecks = 8
+
+// addFindingsConcurrently runs check for each of servers concurrently, up to
+// maxConcurrentChecks at a time, adding the findings in server order so that
+// the response is stable.
+func (data *responseData) addFindingsConcurrently(servers serverList, check func(*server) []*finding) {
+	var (
+		wg       sync.WaitGroup
+		slots    = make(chan struct{}, maxConcurrentChecks)
+		findings = make([][]*finding, len(servers))
+	)
+
+	for i, s := range servers {
+		wg.Add(1)
+		go func(i int, s *server) {
+			defer wg.Done()
+
+			slots <- struct{}{}
+			defer func() { <-slots }()
+
+			findings[i] = check(s)
+		}(i, s)
+	}
+
+	wg.Wait()
+
+	for _, f := range findings {
+		data.Findings = append(data.Findings, f...)
+	}
+}
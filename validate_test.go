@@ -0,0 +1,53 @@
+// Copyright 2015 Michael Johnson. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAddFindingsConcurrently(t *testing.T) {
+	var servers serverList
+	for i := 0; i < 3*maxConcurrentChecks; i++ {
+		servers = append(servers, &server{Target: strconv.Itoa(i) + ".example.test."})
+	}
+
+	var (
+		mu            sync.Mutex
+		running, most int
+	)
+
+	data := &responseData{}
+	data.addFindingsConcurrently(servers, func(s *server) []*finding {
+		mu.Lock()
+		running++
+		most = max(most, running)
+		mu.Unlock()
+
+		time.Sleep(10 * time.Millisecond)
+
+		mu.Lock()
+		running--
+		mu.Unlock()
+
+		return []*finding{{Severity: severityInfo, Target: s.Target}}
+	})
+
+	if most > maxConcurrentChecks {
+		t.Errorf("%d checks ran at once, want at most %d", most, maxConcurrentChecks)
+	}
+
+	if len(data.Findings) != len(servers) {
+		t.Fatalf("findings = %d, want %d", len(data.Findings), len(servers))
+	}
+	for i, f := range data.Findings {
+		if f.Target != servers[i].Target {
+			t.Errorf("finding %d is for %s, want %s", i, f.Target, servers[i].Target)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+// Copyright 2015 Michael Johnson. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"sort"
+)
+
+type versionInfo struct {
+	Version   string     `json:"version"`
+	Revision  string     `json:"revision,omitempty"`
+	GoVersion string     `json:"goVersion"`
+	Features  []*feature `json:"features"`
+}
+
+// feature is an optional part of the service and whether this instance has
+// it enabled.
+type feature struct {
+	Name    string `json:"name"`
+	Enabled bool   `json:"enabled"`
+}
+
+// features reports which optional features the running configuration
+// enables.
+func features() []*feature {
+	redis := false
+	if responseCache != nil {
+		_, redis = responseCache.backend.(*redisCache)
+	}
+
+	tls, experimental := false, false
+	for _, t := range enabledTransports {
+		tls = tls || t.directTLS
+		experimental = experimental || t.experimental
+	}
+
+	enabled := map[string]bool{
+		"admin":                     adminToken != "",
+		"cache":                     responseCache != nil,
+		"capabilities":              capabilityNames != nil,
+		"debug-errors":              debugErrors,
+		"direct-tls":                tls,
+		"dns-rate-limit":            outboundLimiter != nil,
+		"domain-policy":             allowedDomains != nil || deniedDomains != nil,
+		"experimental-transports":   experimental,
+		"fallback":                  implicitFallback,
+		"filter-internal-addresses": filterInternalAddresses,
+		"rate-limit":                requestLimiter != nil,
+		"redis":                     redis,
+		"reverse-index":             reverseTargets != nil,
+		"search-domains":            len(searchDomains) > 0,
+		"ssrf-protection":           ssrfProtection,
+		"status-203":                nonAuthoritativeStatus,
+		"target-policy":             allowedTargets != nil,
+	}
+
+	list := make([]*feature, 0, len(enabled))
+	for name, on := range enabled {
+		list = append(list, &feature{name, on})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+
+	return list
+}
+
+// serveVersion reports the build of the service and which of its features are
+// enabled.
+func serveVersion(w http.ResponseWriter, r *http.Request) {
+	h := w.Header()
+	h.Set("Content-Type", "application/json; charset=utf-8")
+	allowCrossOrigin(h)
+	h.Set("Cache-Control", "no-cache")
+
+	info := &versionInfo{
+		Version:   "(devel)",
+		GoVersion: runtime.Version(),
+		Features:  features(),
+	}
+
+	if build, ok := debug.ReadBuildInfo(); ok {
+		if build.Main.Version != "" {
+			info.Version = build.Main.Version
+		}
+
+		for _, setting := range build.Settings {
+			if setting.Key == "vcs.revision" {
+				info.Revision = setting.Value
+			}
+		}
+	}
+
+	fmt.Fprintln(w, mustJSONEncode(&struct {
+		Version string       `json:"apiVersion"`
+		Data    *versionInfo `json:"data"`
+	}{apiVersion, info}))
+}
@@ -7,25 +7,118 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"flag"
 	"fmt"
-	"hash/crc64"
 	"log"
+	"math"
 	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"reflect"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 )
 
 type server struct {
-	Target   string `json:"target"`
-	Port     uint16 `json:"port"`
-	Priority uint16 `json:"priority"`
-	Weight   uint16 `json:"weight"`
+	Target        string `json:"target"`
+	TargetUnicode string `json:"targetUnicode,omitempty"`
+	Port          uint16 `json:"port"`
+	Priority      uint16 `json:"priority"`
+	Weight        uint16 `json:"weight"`
+	Rank          int    `json:"rank,omitempty"`
+
+	Transport string   `json:"transport,omitempty"`
+	Role      string   `json:"role,omitempty"`
+	Scheme    string   `json:"scheme,omitempty"`
+	Source    string   `json:"source"`
+	Advice    *advice  `json:"advice,omitempty"`
+	Addresses []string `json:"addresses,omitempty"`
+
+	// RTT is the time in milliseconds taken to connect to the server, with
+	// order=rtt.
+	RTT float64 `json:"rttMs,omitempty"`
+
+	StandardPort bool `json:"standardPort,omitempty"`
+
+	// MaxAge is how many seconds the server may be cached for, from the
+	// TTL of its own records, with record-max-age=true.
+	MaxAge *int `json:"maxAge,omitempty"`
+
+	// ttl is the TTL of the records the server came from, or unknownTTL.
+	ttl int64
+
+	// via is the transport the server was found under.
+	via *transport
+
+	// fields, if set, limits the fields marshalled to those named.
+	fields map[string]bool
 }
 
+// serverFields are the JSON names of the fields of a server, in order.
+var serverFields = func() []string {
+	t := reflect.TypeOf(server{})
+
+	var names []string
+	for i := 0; i < t.NumField(); i++ {
+		if f := t.Field(i); f.IsExported() {
+			name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+			names = append(names, name)
+		}
+	}
+
+	return names
+}()
+
+func (s *server) MarshalJSON() ([]byte, error) {
+	type plain server
+
+	encoded, err := json.Marshal((*plain)(s))
+	if err != nil || s.fields == nil {
+		return encoded, err
+	}
+
+	var values map[string]json.RawMessage
+	if err := json.Unmarshal(encoded, &values); err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for _, name := range serverFields {
+		value, ok := values[name]
+		if !ok || !s.fields[name] {
+			continue
+		}
+
+		if buf.Len() > 1 {
+			buf.WriteByte(',')
+		}
+		fmt.Fprintf(&buf, "%q:%s", name, value)
+	}
+	buf.WriteByte('}')
+
+	return buf.Bytes(), nil
+}
+
+// Sources say where a server or alternative came from, so that clients can
+// tell published records from anything the service derived itself.
+const (
+	sourceSRV      = "srv"
+	sourceTXT      = "txt"
+	sourceFallback = "fallback"
+)
+
 type serverList []*server
 
 func (s serverList) Len() int {
@@ -55,12 +148,145 @@ func (s serverList) Less(i, j int) bool {
 		return a.Port < b.Port
 	}
 
+	if a.Transport != b.Transport {
+		return a.Transport < b.Transport
+	}
+
+	if a.Source != b.Source {
+		return a.Source < b.Source
+	}
+
 	return false
 }
 
+// rank numbers the servers from 1 in the order clients should try them:
+// by ascending priority and, within a priority, by descending weight, as
+// the server most likely to be picked by RFC 2782's weighted selection is
+// the heaviest. Servers that compare equal keep their order in the list.
+func (s serverList) rank() {
+	for i, srv := range s.inPreferenceOrder() {
+		srv.Rank = i + 1
+	}
+}
+
+// inPreferenceOrder returns a copy of s in the order described for rank.
+func (s serverList) inPreferenceOrder() serverList {
+	order := make(serverList, len(s))
+	copy(order, s)
+
+	sort.SliceStable(order, func(i, j int) bool {
+		a, b := order[i], order[j]
+		if a.Priority != b.Priority {
+			return a.Priority < b.Priority
+		}
+
+		return a.Weight > b.Weight
+	})
+
+	return order
+}
+
+// withRoles returns clients and s2s as one list for type=both, each server
+// with its role. It is ordered by priority, or with byRTT by RTT, with the
+// clients first among equals, and otherwise keeps each role's own order, so
+// that ranks and shuffling still apply to each role on its own.
+func withRoles(clients, s2s serverList, byRTT bool) serverList {
+	list := make(serverList, 0, len(clients)+len(s2s))
+	for _, srv := range clients {
+		srv.Role = roleClient
+		list = append(list, srv)
+	}
+
+	for _, srv := range s2s {
+		srv.Role = roleServer
+		list = append(list, srv)
+	}
+
+	if byRTT {
+		list.sortByRTT()
+	} else {
+		sort.SliceStable(list, func(i, j int) bool {
+			return list[i].Priority < list[j].Priority
+		})
+	}
+
+	return list
+}
+
+// splitRoles splits a list made by withRoles back into its clients and s2s
+// servers.
+func (s serverList) splitRoles() (clients, s2s serverList) {
+	for _, srv := range s {
+		if srv.Role == roleServer {
+			s2s = append(s2s, srv)
+		} else {
+			clients = append(clients, srv)
+		}
+	}
+
+	return clients, s2s
+}
+
+// firstPerPriority returns the most preferred server of each priority in s,
+// in priority order.
+func (s serverList) firstPerPriority() serverList {
+	var out serverList
+	for _, srv := range s.inPreferenceOrder() {
+		if len(out) == 0 || out[len(out)-1].Priority != srv.Priority {
+			out = append(out, srv)
+		}
+	}
+
+	return out
+}
+
 type alternative struct {
 	Name  string `json:"name"`
 	Value string `json:"value"`
+
+	Source      string   `json:"source"`
+	Addresses   []string `json:"addresses,omitempty"`
+	HostUnicode string   `json:"hostUnicode,omitempty"`
+
+	// MaxAge is like that of a server.
+	MaxAge *int `json:"maxAge,omitempty"`
+
+	// ttl is the TTL of the records the alternative came from, or
+	// unknownTTL.
+	ttl int64
+}
+
+// host returns the host an alternative's URL points at, or "" if the value
+// isn't a URL with a host.
+func (a *alternative) host() string {
+	u, err := url.Parse(a.Value)
+	if err != nil {
+		return ""
+	}
+
+	return u.Hostname()
+}
+
+// canonicalURL returns value with an internationalized host in its ASCII
+// form, so that it can be looked up and compared. Values that aren't URLs, or
+// whose hosts can't be encoded, are returned as they are.
+func canonicalURL(value string) string {
+	u, err := url.Parse(value)
+	if err != nil || isASCII(u.Host) {
+		return value
+	}
+
+	host, err := toASCII(u.Hostname())
+	if err != nil {
+		return value
+	}
+
+	if port := u.Port(); port != "" {
+		host += ":" + port
+	}
+
+	u.Host = host
+	return u.String()
 }
 
 type alternativeList []*alternative
@@ -87,20 +313,120 @@ func (s alternativeList) Less(i, j int) bool {
 	return false
 }
 
+// dedup removes exact duplicates from a sorted list, keeping the one from TXT
+// records if there is one. Distinct values published under the same name are
+// all kept, so that clients can fail over between them.
+func (s alternativeList) dedup() alternativeList {
+	if len(s) == 0 {
+		return s
+	}
+
+	out := s[:1]
+	for _, alt := range s[1:] {
+		last := out[len(out)-1]
+		if alt.Name == last.Name && alt.Value == last.Value {
+			if alt.Source == sourceTXT {
+				out[len(out)-1] = alt
+			}
+			continue
+		}
+
+		out = append(out, alt)
+	}
+
+	return out
+}
+
+type meta struct {
+	Zone   string `json:"zone"`
+	Serial uint32 `json:"serial"`
+}
+
+// debugInfo is added to responses with debug=dns.
+type debugInfo struct {
+	DNS []*dnsExchange `json:"dns"`
+}
+
+type responseData struct {
+	// Domain is the fully-qualified name that was resolved, if a search
+	// domain had to be appended to the one requested or a conventional
+	// subdomain was used instead.
+	Domain string `json:"domain,omitempty"`
+
+	Servers      serverList      `json:"servers"`
+	Alternatives alternativeList `json:"alternatives"`
+
+	// Recommended is the client server to connect to, with
+	// recommended=true.
+	Recommended *recommendation `json:"recommended,omitempty"`
+
+	// Capabilities are the attributes of the TXT records named by
+	// -capability-names.
+	Capabilities []*capability `json:"capabilities,omitempty"`
+
+	// S2SServers are the server-to-server endpoints, returned alongside the
+	// client ones for type=all.
+	S2SServers serverList `json:"s2sServers,omitempty"`
+
+	Meta     *meta      `json:"meta,omitempty"`
+	Findings []*finding `json:"findings,omitempty"`
+	Debug    *debugInfo `json:"debug,omitempty"`
+
+	// domain is the name that was resolved, whether or not a search domain
+	// was appended.
+	domain string
+
+	// ttl is the smallest TTL of the records, in seconds, or unknownTTL.
+	ttl int64
+
+	// NonAuthoritative is set if any of the data came from somewhere other
+	// than DNS, such as a fallback or an HTTP-based lookup.
+	NonAuthoritative bool `json:"nonAuthoritative,omitempty"`
+
+	// Warnings say how the data may be incomplete, such as when some
+	// records could not be used.
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// allServers returns both the client and server-to-server servers.
+func (data *responseData) allServers() serverList {
+	return append(data.Servers[:len(data.Servers):len(data.Servers)], data.S2SServers...)
+}
+
+// apiVersion is the version of the response schema, reported as apiVersion
+// in every response envelope and error body.
+const apiVersion = "1.0"
+
 type response struct {
 	Version string `json:"apiVersion"`
 
-	Data *struct {
-		Servers      serverList      `json:"servers"`
-		Alternatives alternativeList `json:"alternatives"`
-	} `json:"data,omitempty"`
-	Error *struct {
-		Code    int    `json:"code"`
-		Message string `json:"message"`
-	} `json:"error,omitempty"`
+	Data  *responseData  `json:"data,omitempty"`
+	Error *responseError `json:"error,omitempty"`
+}
+
+type responseError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+
+	// Detail is the underlying error, only included when debugging.
+	Detail string `json:"detail,omitempty"`
+
+	// Hints say what a domain without records has instead, with hints=true.
+	Hints []*hint `json:"hints,omitempty"`
 }
 
-var crcTable = crc64.MakeTable(crc64.ISO)
+// etagFor returns a strong validator for an encoded response.
+//
+// A collision would let a client keep serving stale records under a matching
+// ETag, so this uses SHA-256 rather than a checksum such as CRC-64, which
+// only guards against accidental corruption, or a fast non-cryptographic hash
+// such as FNV. Responses are a few hundred bytes, so the cost is negligible
+// next to the DNS lookups. 128 bits of the digest are kept to keep the header
+// short.
+func etagFor(encoded []byte) string {
+	sum := sha256.Sum256(encoded)
+	return "\"" + hex.EncodeToString(sum[:16]) + "\""
+}
 
 func mustJSONEncode(data interface{}) string {
 	encoded, err := json.Marshal(data)
@@ -111,31 +437,424 @@ func mustJSONEncode(data interface{}) string {
 	return string(encoded)
 }
 
-var (
-	internalServerError = mustJSONEncode(&response{
-		Version: "1.0",
-
-		Error: &struct {
-			Code    int    `json:"code"`
-			Message string `json:"message"`
-		}{
-			Code:    500,
-			Message: "An internal server error has occured.",
-		},
-	})
-	notFoundError = mustJSONEncode(&response{
-		Version: "1.0",
-
-		Error: &struct {
-			Code    int    `json:"code"`
-			Message string `json:"message"`
-		}{
-			Code:    404,
-			Message: "The given domain name does not contain any relevant records.",
+func errorJSON(code int, message string) string {
+	return mustJSONEncode(&response{
+		Version: apiVersion,
+
+		Error: &responseError{
+			Code:    code,
+			Message: message,
 		},
 	})
+}
+
+// withDetail returns the error response body with err added as its detail.
+func withDetail(body string, err error) string {
+	var resp response
+	if json.Unmarshal([]byte(body), &resp) != nil || resp.Error == nil {
+		return body
+	}
+
+	resp.Error.Detail = err.Error()
+	return mustJSONEncode(&resp)
+}
+
+var (
+	internalServerError  = errorJSON(500, "An internal server error has occured.")
+	notFoundError        = errorJSON(404, "The given domain name does not contain any relevant records.")
+	serviceDisabledError = errorJSON(404, "The given domain name has explicitly disabled the requested XMPP service.")
+	dnssecError          = errorJSON(502, "DNSSEC validation failed for the given domain name.")
+	dnssecUncheckedError = errorJSON(502, "DNSSEC validation could not be checked for the given domain name.")
+	forbiddenError       = errorJSON(403, "The requested options require admin access.")
+	overloadedError      = errorJSON(503, "The service is overloaded; try again later.")
+	domainDeniedError    = errorJSON(403, "This service does not resolve the requested domain.")
+	adminOnlyError       = errorJSON(403, "This endpoint requires admin access.")
+)
+
+// implicitFallback is the default of the fallback parameter, set from the
+// -fallback flag. The parameter always takes precedence.
+var implicitFallback bool
+
+// Values of the type parameter.
+const (
+	typeClient = "client"
+	typeServer = "server"
+	typeAll    = "all"
+	typeBoth   = "both"
 )
 
+// options holds the query parameters accepted by serve. Any option that
+// changes the response body must also be added to cacheKey.
+type options struct {
+	// envelope wraps the data in the {apiVersion, data} envelope. When
+	// false the data object is returned at the top level. Errors are always
+	// enveloped so that they can be told apart from data.
+	envelope bool
+
+	// etag is compared against the response ETag as a fallback for clients
+	// behind proxies that strip If-None-Match.
+	etag string
+
+	// advice adds connection-security advice to each server.
+	advice bool
+
+	// meta adds the serial of the zone's SOA record, as a cheap indicator
+	// of whether the zone may have changed.
+	meta bool
+
+	// resolve adds the addresses of each server target and alternative
+	// host.
+	resolve bool
+
+	// dnssecStrict fails the request when a validating resolver reports
+	// bogus records, rather than treating it like any other lookup failure.
+	dnssecStrict bool
+
+	// resolver is the address of a DNS server to use for this request only.
+	// It requires admin access.
+	resolver string
+
+	// class is the class of the SRV and TXT queries, which is IN unless
+	// another is wanted for troubleshooting. It requires admin access.
+	class uint16
+
+	// validate adds findings about the domain's configuration.
+	validate bool
+
+	// checkTLS adds findings about the certificates of direct TLS servers
+	// in validate mode. It requires admin access, as it connects to them.
+	checkTLS bool
+
+	// probe adds findings from opening an XMPP stream to each server in
+	// validate mode. It requires admin access, as it connects to them.
+	probe bool
+
+	// serviceType selects the client servers, the server-to-server ones, or
+	// both.
+	serviceType string
+
+	// scheme adds the scheme of each server's SRV service.
+	scheme bool
+
+	// web adds the alternatives in the domain's host-meta document.
+	web bool
+
+	// profile is the preset the other options were defaulted from, if any.
+	profile string
+
+	// shuffle orders the servers afresh for each request, even from the
+	// cache, by RFC 2782's weighted random selection.
+	shuffle bool
+
+	// clientKey seeds the shuffle, so that each key gets the same order
+	// for the same records. It implies shuffle.
+	clientKey string
+
+	// recommended adds the client server to connect to, preferring direct
+	// TLS.
+	recommended bool
+
+	// recordMaxAge adds the maxAge of each server and alternative.
+	recordMaxAge bool
+
+	// fallback adds the domain itself on the default port for each role
+	// without SRV records, as RFC 6120 has clients do. It defaults to
+	// -fallback.
+	fallback bool
+
+	// probeSubdomains falls back to the conventional subdomains when the
+	// domain has no records.
+	probeSubdomains bool
+
+	// hints adds hints to a 404 about what the domain has instead.
+	hints bool
+
+	// rank adds each server's 1-based position in the order clients
+	// should try them.
+	rank bool
+
+	// order is how servers are ordered: by priority and weight, or by the
+	// time taken to connect to them.
+	order string
+
+	// debugErrors includes the underlying error in error responses. It is
+	// set for every request by -debug-errors, and otherwise requires admin
+	// access.
+	debugErrors bool
+
+	// debugDNS adds the header flags of every DNS reply. It requires admin
+	// access.
+	debugDNS bool
+
+	// unicode adds the Unicode form of internationalized server targets
+	// and alternative hosts.
+	unicode bool
+
+	// fields limits the fields returned for each server, if set.
+	fields map[string]bool
+
+	// format is the representation the response is encoded in. It is nil
+	// unless given by the format parameter, in which case it overrides the
+	// Accept header.
+	format *format
+}
+
+func parseBool(query url.Values, name string, def bool) (bool, error) {
+	value := query.Get(name)
+	if value == "" {
+		return def, nil
+	}
+
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("Invalid value %q for the %s parameter.", value, name)
+	}
+
+	return b, nil
+}
+
+// How parameters given more than once are handled, set by -duplicate-params.
+const (
+	duplicatesReject = "reject"
+	duplicatesFirst  = "first"
+	duplicatesLast   = "last"
+)
+
+var duplicateParams = duplicatesReject
+
+// multiValued are the parameters that may be given more than once, whatever
+// -duplicate-params says: /batch takes a domain parameter per domain.
+var multiValued = map[string]bool{"domain": true}
+
+// singleValued returns query with one value for each parameter that isn't
+// multi-valued, following -duplicate-params: the first or last of them, or
+// an error if there is more than one.
+func singleValued(query url.Values) (url.Values, error) {
+	names := make([]string, 0, len(query))
+	for name, values := range query {
+		if len(values) > 1 && !multiValued[name] {
+			names = append(names, name)
+		}
+	}
+
+	if len(names) == 0 {
+		return query, nil
+	}
+	sort.Strings(names)
+
+	if duplicateParams == duplicatesReject {
+		return nil, fmt.Errorf("The %s parameter was given more than once.", names[0])
+	}
+
+	single := make(url.Values, len(query))
+	for name, values := range query {
+		single[name] = values
+	}
+
+	for _, name := range names {
+		values := query[name]
+		if duplicateParams == duplicatesLast {
+			single[name] = values[len(values)-1:]
+		} else {
+			single[name] = values[:1]
+		}
+	}
+
+	return single, nil
+}
+
+func parseOptions(query url.Values) (*options, error) {
+	var (
+		opts = &options{}
+		err  error
+	)
+
+	if query, err = singleValued(query); err != nil {
+		return nil, err
+	}
+
+	switch opts.profile = query.Get("profile"); opts.profile {
+	case "":
+	case profileMobile:
+		query = withDefaults(query, mobileProfile)
+	default:
+		return nil, fmt.Errorf("Invalid value %q for the profile parameter; expected mobile.", opts.profile)
+	}
+
+	if opts.envelope, err = parseBool(query, "envelope", true); err != nil {
+		return nil, err
+	}
+
+	opts.etag = query.Get("etag")
+
+	if opts.advice, err = parseBool(query, "advice", false); err != nil {
+		return nil, err
+	}
+
+	if opts.meta, err = parseBool(query, "meta", false); err != nil {
+		return nil, err
+	}
+
+	if opts.resolve, err = parseBool(query, "resolve", false); err != nil {
+		return nil, err
+	}
+
+	switch value := query.Get("dnssec"); value {
+	case "", "permissive":
+	case "strict":
+		opts.dnssecStrict = true
+	default:
+		return nil, fmt.Errorf("Invalid value %q for the dnssec parameter.", value)
+	}
+
+	if opts.validate, err = parseBool(query, "validate", false); err != nil {
+		return nil, err
+	}
+
+	if opts.checkTLS, err = parseBool(query, "tlscheck", false); err != nil {
+		return nil, err
+	}
+
+	if opts.checkTLS && !opts.validate {
+		return nil, fmt.Errorf("The tlscheck parameter requires validate=true.")
+	}
+
+	if opts.probe, err = parseBool(query, "probe", false); err != nil {
+		return nil, err
+	}
+
+	if opts.probe && !opts.validate {
+		return nil, fmt.Errorf("The probe parameter requires validate=true.")
+	}
+
+	switch name := query.Get("format"); name {
+	case "":
+	case "config":
+		client := query.Get("client")
+		if opts.format = configFormats[client]; opts.format == nil {
+			return nil, fmt.Errorf("Invalid value %q for the client parameter; expected one of %s.", client, strings.Join(configClients(), ", "))
+		}
+	default:
+		if opts.format = formats[name]; opts.format == nil {
+			return nil, fmt.Errorf("Invalid value %q for the format parameter; expected json, msgpack or config.", name)
+		}
+	}
+
+	switch opts.serviceType = query.Get("type"); opts.serviceType {
+	case "":
+		opts.serviceType = typeClient
+	case typeClient, typeServer, typeAll, typeBoth:
+	default:
+		return nil, fmt.Errorf("Invalid value %q for the type parameter; expected client, server, all or both.", opts.serviceType)
+	}
+
+	if opts.scheme, err = parseBool(query, "scheme", false); err != nil {
+		return nil, err
+	}
+
+	if opts.recommended, err = parseBool(query, "recommended", false); err != nil {
+		return nil, err
+	}
+
+	if opts.rank, err = parseBool(query, "rank", false); err != nil {
+		return nil, err
+	}
+
+	if opts.web, err = parseBool(query, "web", false); err != nil {
+		return nil, err
+	}
+
+	if opts.fallback, err = parseBool(query, "fallback", implicitFallback); err != nil {
+		return nil, err
+	}
+
+	if opts.recordMaxAge, err = parseBool(query, "record-max-age", false); err != nil {
+		return nil, err
+	}
+
+	if opts.probeSubdomains, err = parseBool(query, "probe-subdomains", false); err != nil {
+		return nil, err
+	}
+
+	if opts.hints, err = parseBool(query, "hints", false); err != nil {
+		return nil, err
+	}
+
+	if opts.clientKey = query.Get("client-key"); len(opts.clientKey) > maxClientKeyLength {
+		return nil, fmt.Errorf("The client-key parameter must be at most %d bytes.", maxClientKeyLength)
+	}
+
+	if opts.shuffle, err = parseBool(query, "shuffle", opts.clientKey != ""); err != nil {
+		return nil, err
+	}
+
+	if opts.clientKey != "" && !opts.shuffle {
+		return nil, fmt.Errorf("The client-key parameter cannot be used with shuffle=false.")
+	}
+
+	switch opts.order = query.Get("order"); opts.order {
+	case "":
+		opts.order = orderPriority
+	case orderPriority, orderRTT:
+	default:
+		return nil, fmt.Errorf("Invalid value %q for the order parameter; expected priority or rtt.", opts.order)
+	}
+
+	if opts.shuffle && opts.order == orderRTT {
+		return nil, fmt.Errorf("The shuffle and client-key parameters cannot be used with order=rtt.")
+	}
+
+	if list := query.Get("debug"); list != "" {
+		for _, value := range strings.Split(list, ",") {
+			switch value {
+			case "errors":
+				opts.debugErrors = true
+			case "dns":
+				opts.debugDNS = true
+			default:
+				return nil, fmt.Errorf("Invalid value %q for the debug parameter; expected errors or dns.", value)
+			}
+		}
+	}
+
+	if opts.unicode, err = parseBool(query, "unicode", false); err != nil {
+		return nil, err
+	}
+
+	if list := query.Get("fields"); list != "" {
+		opts.fields = make(map[string]bool)
+		for _, name := range strings.Split(list, ",") {
+			name = strings.TrimSpace(name)
+			if !slices.Contains(serverFields, name) {
+				return nil, fmt.Errorf("Unknown server field %q in the fields parameter.", name)
+			}
+
+			opts.fields[name] = true
+		}
+	}
+
+	if opts.resolver = query.Get("resolver"); opts.resolver != "" {
+		host, port, err := net.SplitHostPort(opts.resolver)
+		if err != nil || net.ParseIP(host) == nil {
+			return nil, fmt.Errorf("Invalid value %q for the resolver parameter; expected an IP address and port.", opts.resolver)
+		}
+
+		if n, err := strconv.ParseUint(port, 10, 16); err != nil || n == 0 {
+			return nil, fmt.Errorf("Invalid port in the resolver parameter %q.", opts.resolver)
+		}
+	}
+
+	opts.class = dnsClassINET
+	if name := query.Get("class"); name != "" {
+		var ok bool
+		if opts.class, ok = dnsClasses[strings.ToUpper(name)]; !ok {
+			return nil, fmt.Errorf("Invalid value %q for the class parameter; expected IN, CH or HS.", name)
+		}
+	}
+
+	return opts, nil
+}
+
 // We duplicate the http.Error function because we don't want it to set
 // Content-Type
 func httpError(w http.ResponseWriter, error string, code int) {
@@ -143,110 +862,792 @@ func httpError(w http.ResponseWriter, error string, code int) {
 	fmt.Fprintln(w, error)
 }
 
+// deprecatedParams lists query parameters that are still honored but are
+// scheduled for removal. Keys are either a bare parameter name, matching any
+// value, or "name=value", matching only that value. Requests to /{domain} and
+// /batch using one, and /rpc calls with one in their options, get a 299
+// Warning header carrying the associated text. They are listed under
+// deprecated in the usage the root returns.
+//
+// No parameters are currently deprecated.
+var deprecatedParams = map[string]string{}
+
+// warnDeprecated adds a Warning header for each deprecated parameter used in
+// query, once for each text.
+func warnDeprecated(h http.Header, query url.Values) {
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	warned := make(map[string]bool)
+	for _, name := range names {
+		keys := []string{name}
+		for _, value := range query[name] {
+			keys = append(keys, name+"="+value)
+		}
+
+		for _, key := range keys {
+			if text, ok := deprecatedParams[key]; ok && !warned[text] {
+				warned[text] = true
+				h.Add("Warning", "299 xmppresolv "+strconv.Quote(text))
+			}
+		}
+	}
+}
+
+// etagMatches reports whether the client-supplied value names etag. The quotes
+// and weak prefix are optional, since they are awkward to put in a URL.
+func etagMatches(value, etag string) bool {
+	value = strings.TrimPrefix(value, "W/")
+	return strings.Trim(value, "\"") == strings.Trim(etag, "\"")
+}
+
+// defaultMaxAge is how long, in seconds, clients and the response cache may
+// reuse a response whose records' TTLs aren't known, and errors.
+const defaultMaxAge = 900
+
+// maxRespectedTTL caps, in seconds, how long a response may be reused however
+// long its records' TTLs are. A lower cap means more lookups but makes changes
+// to zones with very long TTLs show up sooner.
+var maxRespectedTTL = 3600
+
+// maxAgeFor returns how long, in seconds, a response may be reused given the
+// smallest TTL of its records.
+func maxAgeFor(ttl int64) int {
+	maxAge := int64(defaultMaxAge)
+	if ttl != unknownTTL {
+		maxAge = ttl
+	}
+
+	return int(min(maxAge, int64(maxRespectedTTL)))
+}
+
+// requestError is the status code and JSON body of a failed request.
+type requestError struct {
+	code int
+	body string
+}
+
+func encodeResponse(data *responseData, opts *options) ([]byte, error) {
+	for _, s := range data.allServers() {
+		s.fields = opts.fields
+	}
+
+	if !opts.envelope {
+		return opts.responseFormat().marshal(data)
+	}
+
+	return opts.responseFormat().marshal(&response{
+		Version: apiVersion,
+		Data:    data,
+	})
+}
+
+// docsURL is where browsers requesting the root are redirected to.
+var docsURL string
+
+type apiUsage struct {
+	Endpoints  map[string]string `json:"endpoints"`
+	Parameters map[string]string `json:"parameters"`
+
+	// Deprecated are the deprecatedParams.
+	Deprecated map[string]string `json:"deprecated,omitempty"`
+
+	// Notes apply to every endpoint and depend on the configuration.
+	Notes []string `json:"notes,omitempty"`
+}
+
+// usage describes the API in response to requests for the root.
+var usage = &apiUsage{
+	Endpoints: map[string]string{
+		"GET /{domain}":        "Resolve the XMPP client records of a domain, as JSON or, with Accept: application/msgpack, MessagePack.",
+		"GET /{domain}/{type}": "The same as GET /{domain}?type={type}, for type client, server, all or both.",
+		"POST /batch":          "Resolve a JSON array of domains, with the same parameters applying to each.",
+		"GET /batch":           "The same as POST /batch for the domains given as repeated domain parameters, with a combined ETag.",
+		"POST /rpc":            "Resolve JSON-RPC 2.0 requests, singly or in a batch, calling resolve with a domain and its own options.",
+		"GET /admin/stats":     "Internal state, such as cache usage. Requires admin access.",
+		"GET /reverse":         "The domains this instance has resolved, or prewarmed, since it started whose SRV records target the host given as target, most recently seen first. Not exhaustive, as DNS can't be searched this way. Requires admin access.",
+		"GET /version":         "The build of the service and which optional features are enabled.",
+		"GET /readyz":          "200 when the service is ready for traffic; 503 while the resolvers are warmed up or the cache is prewarmed.",
+	},
+	Parameters: map[string]string{
+		"advice":           "true to add connection-security advice to each server.",
+		"client":           "With format=config, the client library to write a config snippet for: smack or strophe.",
+		"client-key":       "An opaque key, such as a hash of the user's JID, to shuffle servers as shuffle=true does but the same way each time for that key, for sticky routing without sessions. Advisory: the order only stays the same while the domain's records do. Implies shuffle=true.",
+		"debug":            "Comma-separated: errors to include the underlying error in error responses, dns to add the header flags (aa, tc, ra, ad) of every DNS reply under debug.dns. Requires admin access.",
+		"dnssec":           "strict to fail with 502 when a validating resolver reports bogus records, or when validation can't be checked.",
+		"envelope":         "false to return the data object without the apiVersion envelope.",
+		"etag":             "The last ETag seen, for clients whose proxies strip If-None-Match.",
+		"fallback":         "true to add the domain itself on the default port, with source fallback, for each role without SRV records, if it has addresses (RFC 6120), or false not to. Defaults to the server's -fallback setting.",
+		"fields":           "Comma-separated server fields to return, such as target,port. Defaults to all.",
+		"format":           "json or msgpack, overriding the Accept header, or config for a connection config snippet for the library named by client.",
+		"hints":            "true to add hints to a 404 when the domain resolves or has MX records, such as for an email domain. The lookups are bounded by the server's -hints-timeout.",
+		"meta":             "true to add the zone's SOA serial.",
+		"order":            "priority (the default) to order servers by SRV priority and weight, or rtt to put those connected to fastest first, with each server's rttMs. Experimental; requires admin access.",
+		"probe":            "true, with validate=true, to open an XMPP stream to each server and report what it offers. Requires admin access.",
+		"probe-subdomains": "true to fall back to the first of the conventional subdomains, such as xmpp.{domain}, with records when the domain has none, reporting it as domain.",
+		"profile":          "mobile for a compact response: only the most preferred server of each priority, with its target, port and addresses, cacheable by the client past its max-age if the service can't be reached. Explicit parameters override the profile's.",
+		"rank":             "true to add each server's 1-based position in the order to try them.",
+		"class":            "IN (the default), CH or HS, the class of the SRV and TXT queries, for troubleshooting. Requires admin access.",
+		"recommended":      "true to add recommended: the client server to connect to, the first direct TLS one if there is any, and otherwise the first STARTTLS one, with the reason. Only enabled transports are considered.",
+		"record-max-age":   "true to add maxAge to each server and alternative: the seconds it may be cached for, from the TTL of its own records. Like the response's max-age, they count from when the records were resolved, which the Age header gives for cached responses.",
+		"resolve":          "true to add the addresses of server targets and alternative hosts.",
+		"resolver":         "ip:port of a DNS server to use instead of the default. Requires admin access.",
+		"tlscheck":         "true, with validate=true, to check the certificates of direct TLS servers. Requires admin access.",
+		"scheme":           "true to add each server's scheme: xmpp for STARTTLS services, xmpps for direct TLS ones.",
+		"type":             "client (the default) for client servers, server for server-to-server ones in servers, all for both, with the latter in s2sServers, or both for both in servers, each with its role, ordered by priority.",
+		"unicode":          "true to add the Unicode form of internationalized server targets and alternative hosts.",
+		"validate":         "true to add findings about the domain's configuration.",
+		"web":              "true to add the alternatives in the domain's host-meta document (XEP-0156), fetched alongside the DNS lookups.",
+	},
+	Deprecated: deprecatedParams,
+}
+
+// serveRoot redirects browsers to the documentation, if configured, and
+// describes the API to everyone else.
+func serveRoot(w http.ResponseWriter, r *http.Request) {
+	h := w.Header()
+	h.Set("Vary", "Accept")
+	allowCrossOrigin(h)
+
+	accept := r.Header.Get("Accept")
+	if docsURL != "" && acceptQuality(accept, "text/html") > acceptQuality(accept, "application/json") {
+		http.Redirect(w, r, docsURL, http.StatusFound)
+		return
+	}
+
+	h.Set("Content-Type", "application/json; charset=utf-8")
+	fmt.Fprintln(w, mustJSONEncode(&struct {
+		Version string    `json:"apiVersion"`
+		Usage   *apiUsage `json:"usage"`
+	}{apiVersion, usage}))
+}
+
+// domainRequests counts requests for the most requested domains.
+var domainRequests *topCounter
+
+// profileMobile is a compact profile for mobile clients: only the most
+// preferred server of each priority, with just its target, port and
+// addresses, and caching advice that lets a client fall back to a stale
+// response when it can't reach the service.
+const profileMobile = "mobile"
+
+// mobileProfile are the options profile=mobile defaults. It also keeps only
+// the first server in each priority, which no option does.
+var mobileProfile = url.Values{
+	"resolve": {"true"},
+	"fields":  {"target,port,addresses"},
+}
+
+// withDefaults returns query with the values in defaults for the parameters
+// it doesn't have.
+func withDefaults(query, defaults url.Values) url.Values {
+	merged := make(url.Values, len(query)+len(defaults))
+	for name, values := range defaults {
+		merged[name] = values
+	}
+
+	for name, values := range query {
+		merged[name] = values
+	}
+
+	return merged
+}
+
+// requestOptions parses the options for r from query, checking that the
+// client is allowed to use them.
+func requestOptions(r *http.Request, query url.Values) (*options, *requestError) {
+	opts, err := parseOptions(query)
+	if err != nil {
+		return nil, &requestError{http.StatusBadRequest, errorJSON(http.StatusBadRequest, err.Error())}
+	}
+
+	// An arbitrary resolver could be used to probe internal hosts, and TLS
+	// checks, stream probes and RTT ordering connect to whatever the records
+	// point at, so they are all restricted to admins, as are the query class
+	// and DNS flags, which are only for troubleshooting.
+	if (opts.resolver != "" || opts.class != dnsClassINET || opts.debugDNS || opts.checkTLS || opts.probe || opts.order == orderRTT) && !isAdmin(r) {
+		return nil, &requestError{http.StatusForbidden, forbiddenError}
+	}
+
+	// Underlying errors can reveal internal addresses and configuration.
+	if opts.debugErrors && !debugErrors && !isAdmin(r) {
+		return nil, &requestError{http.StatusForbidden, forbiddenError}
+	}
+	opts.debugErrors = opts.debugErrors || debugErrors
+
+	return opts, nil
+}
+
+// context returns ctx with any lookup settings from opts applied.
+func (opts *options) context(ctx context.Context) context.Context {
+	if opts.resolver != "" {
+		ctx = withResolver(ctx, opts.resolver)
+	}
+
+	if opts.class != dnsClassINET {
+		ctx = withQueryClass(ctx, opts.class)
+	}
+
+	return ctx
+}
+
+// diagnostic reports whether the response is particular to this request and
+// so mustn't be cached: that from an overridden resolver or query class, or
+// with DNS flags, mustn't be served to anyone else, nor RTTs, TLS checks or
+// probes, which are only true of the moment they were made.
+func (opts *options) diagnostic() bool {
+	return opts.resolver != "" || opts.class != dnsClassINET || opts.debugDNS || opts.order == orderRTT || opts.checkTLS || opts.probe
+}
+
+// responseFormat returns the format the response is encoded in: format, or
+// defaultFormat for requests that didn't give or negotiate one.
+func (opts *options) responseFormat() *format {
+	if opts.format == nil {
+		return defaultFormat
+	}
+
+	return opts.format
+}
+
+// cachedResponse returns the encoded response for domain, from the cache if
+// possible, and whether it was.
+func cachedResponse(ctx context.Context, domain string, opts *options) (*cacheEntry, bool, *requestError) {
+	if !domainPermitted(domain) {
+		return nil, false, &requestError{http.StatusForbidden, domainDeniedError}
+	}
+
+	key := ""
+	if !opts.diagnostic() {
+		key = cacheKey(domain, opts)
+	}
+
+	if opts.shuffle {
+		return shuffledResponse(ctx, domain, opts, key)
+	}
+
+	if entry := responseCache.get(key); entry != nil {
+		return entry, true, nil
+	}
+
+	data, rerr := resolveSearch(ctx, domain, opts)
+	if rerr != nil {
+		return nil, false, rerr
+	}
+
+	encoded, err := encodeResponse(data, opts)
+	if err != nil {
+		log.Fatalf("Error marshalling %s for %q: %v", opts.responseFormat().name, domain, err)
+	}
+
+	entry := newCacheEntry(encoded, data)
+	responseCache.set(key, entry, entry.ttl())
+
+	return entry, false, nil
+}
+
+// pathSelector applies the type given as a path segment after the domain to
+// query. Anything but a single known type is refused rather than looked up
+// as part of the domain.
+func pathSelector(selector string, query url.Values) *requestError {
+	switch selector {
+	case "":
+		return nil
+	case typeClient, typeServer, typeAll, typeBoth:
+	default:
+		return &requestError{http.StatusNotFound, errorJSON(http.StatusNotFound, fmt.Sprintf("Unknown path /%s after the domain; expected /client, /server, /all or /both.", selector))}
+	}
+
+	if t := query.Get("type"); t != "" && t != selector {
+		return &requestError{http.StatusBadRequest, errorJSON(http.StatusBadRequest, fmt.Sprintf("The path selects type %s but the type parameter is %q.", selector, t))}
+	}
+
+	query.Set("type", selector)
+	return nil
+}
+
+// nonAuthoritativeStatus makes responses served from the cache or including
+// data from outside DNS use 203 Non-Authoritative Information rather than 200.
+var nonAuthoritativeStatus bool
+
+// statusRewriter replaces one status code with another.
+type statusRewriter struct {
+	http.ResponseWriter
+	from, to int
+}
+
+func (w *statusRewriter) WriteHeader(code int) {
+	if code == w.from {
+		code = w.to
+	}
+
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// debugErrors includes the underlying error in every error response.
+var debugErrors bool
+
+// slowRequestThreshold is the duration after which a request is logged as
+// slow, along with the lookups that took longest. Zero disables the log.
+var slowRequestThreshold time.Duration
+
+func logIfSlow(domain string, start time.Time, timings *lookupTimings) {
+	elapsed := time.Since(start)
+	if elapsed < slowRequestThreshold {
+		return
+	}
+
+	var lookups []string
+	for _, l := range timings.slowest(5) {
+		lookups = append(lookups, fmt.Sprintf("%s (%v)", l.label, l.duration.Round(time.Millisecond)))
+	}
+
+	log.Printf("WARN slow request for %q took %v; slowest lookups: %s", domain, elapsed.Round(time.Millisecond), strings.Join(lookups, ", "))
+}
+
 func serve(w http.ResponseWriter, r *http.Request) {
+	if servePreflight(w, r, "GET") {
+		return
+	}
+
 	if r.Method != "GET" {
 		http.Error(w, fmt.Sprintf("This resource does not accept %s requests.", r.Method), http.StatusMethodNotAllowed)
 		return
 	}
 
-	domain := r.URL.Path[1:]
+	// The path is /{domain}, optionally followed by /{type} as an
+	// alternative to the type parameter.
+	domain, selector, _ := strings.Cut(r.URL.Path[1:], "/")
+	if domain == "" {
+		serveRoot(w, r)
+		return
+	}
+
+	if slowRequestThreshold > 0 {
+		timings := &lookupTimings{}
+		r = r.WithContext(withLookupTimings(r.Context(), timings))
+		defer logIfSlow(domain, time.Now(), timings)
+	}
 
 	h := w.Header()
 	h.Set("Content-Type", "application/json; charset=utf-8")
-	h.Set("Cache-Control", "public, max-age=900")
-	h.Set("Access-Control-Allow-Origin", "*")
+	h.Set("Cache-Control", "public, max-age="+strconv.Itoa(maxAgeFor(unknownTTL)))
+	allowCrossOrigin(h)
+	h.Set("Vary", "Accept")
 
-	srvFound := true
-	_, srv, err := net.LookupSRV("xmpp-client", "tcp", domain)
-	if err != nil {
-		if !strings.HasSuffix(err.Error(), "DNS name does not exist.") {
-			log.Printf("Error resolving SRV records for %q: %v", domain, err)
-			httpError(w, internalServerError, http.StatusInternalServerError)
-			return
+	query := r.URL.Query()
+	warnDeprecated(h, query)
+
+	if rerr := pathSelector(selector, query); rerr != nil {
+		httpError(w, rerr.body, rerr.code)
+		return
+	}
+
+	opts, rerr := requestOptions(r, query)
+	if rerr != nil {
+		httpError(w, rerr.body, rerr.code)
+		return
+	}
+
+	if opts.diagnostic() || opts.debugErrors {
+		h.Set("Cache-Control", "private, no-store")
+	}
+
+	// Errors are always JSON, so the format only applies to data.
+	if opts.format == nil {
+		opts.format = negotiateFormat(r.Header.Get("Accept"))
+	}
+
+	domainRequests.observe(strings.ToLower(domain))
+
+	entry, hit, rerr := cachedResponse(opts.context(r.Context()), domain, opts)
+	if rerr != nil {
+		if rerr.code == http.StatusServiceUnavailable {
+			// Overload is momentary, so the error mustn't be cached.
+			h.Set("Cache-Control", "no-store")
+			h.Set("Retry-After", "1")
 		}
 
-		srvFound = false
+		httpError(w, rerr.body, rerr.code)
+		return
 	}
 
-	txtFound := true
-	txt, err := net.LookupTXT("_xmppconnect." + domain)
-	if err != nil {
-		if !strings.HasSuffix(err.Error(), "DNS name does not exist.") {
-			log.Printf("Error resolving TXT records for %q: %v", domain, err)
-			httpError(w, internalServerError, http.StatusInternalServerError)
-			return
+	if hit {
+		h.Set("X-Cache", "HIT")
+	} else {
+		h.Set("X-Cache", "MISS")
+	}
+
+	// Clients may reuse the response for as long as it remains cached here.
+	// Shuffled responses are kept out of shared caches, which would give
+	// everyone the same order. With per-record max-ages, which count from
+	// when the records were resolved, the response's does too, and its Age
+	// says how long ago that was.
+	if !opts.diagnostic() && !opts.debugErrors {
+		maxAge := max(int(math.Ceil(time.Until(entry.Expires).Seconds())), 0)
+		if opts.recordMaxAge {
+			maxAge = int(math.Ceil(entry.Expires.Sub(entry.Resolved).Seconds()))
+			if age := int(time.Since(entry.Resolved).Seconds()); age > 0 {
+				h.Set("Age", strconv.Itoa(age))
+			}
+		}
+
+		visibility := "public"
+		if opts.shuffle {
+			visibility = "private"
 		}
 
-		txtFound = false
+		cacheControl := visibility + ", max-age=" + strconv.Itoa(maxAge)
+		if opts.profile == profileMobile {
+			cacheControl += ", stale-if-error=" + strconv.Itoa(maxRespectedTTL)
+		}
+		h.Set("Cache-Control", cacheControl)
+	}
+
+	h.Set("Content-Type", opts.format.contentType)
+
+	etag := entry.ETag
+	h.Set("ETag", etag)
+
+	if entry.Signature != "" {
+		h.Set(signatureHeader, entry.Signature)
 	}
 
-	if !txtFound && !srvFound {
-		httpError(w, notFoundError, http.StatusNotFound)
+	// The If-None-Match header takes precedence, so the etag parameter is
+	// only consulted when it is absent.
+	if r.Header.Get("If-None-Match") == "" && opts.etag != "" && etagMatches(opts.etag, etag) {
+		h.Del("Content-Type")
+		w.WriteHeader(http.StatusNotModified)
 		return
 	}
 
-	res := &response{
-		Version: "1.0",
+	if nonAuthoritativeStatus && (hit || entry.NonAuthoritative) {
+		w = &statusRewriter{ResponseWriter: w, from: http.StatusOK, to: http.StatusNonAuthoritativeInfo}
+	}
 
-		Data: &struct {
-			Servers      serverList      `json:"servers"`
-			Alternatives alternativeList `json:"alternatives"`
-		}{
-			Servers:      make([]*server, len(srv)),
-			Alternatives: make([]*alternative, len(txt)),
-		},
+	content := bytes.NewReader(entry.Body)
+	http.ServeContent(w, r, domain, time.Time{}, content)
+}
+
+func main() {
+	log.SetFlags(log.Lshortfile)
+
+	listen := flag.String("listen", "127.0.0.1:8080", "comma-separated list of addresses to listen on")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 10*time.Second, "time allowed for in-flight requests to finish on shutdown")
+	transports := flag.String("transports", "tcp", "comma-separated list of SRV transports to query (tcp, tls, quic)")
+	experimental := flag.Bool("experimental", false, "allow experimental transports")
+	flag.IntVar(&maxRequestLookups, "max-request-lookups", maxRequestLookups, "maximum concurrent DNS lookups per request (0 for no limit)")
+	maxLookups := flag.Int("max-lookups", 256, "maximum concurrent DNS lookups across all requests (0 for no limit)")
+	flag.DurationVar(&slowRequestThreshold, "slow-request-threshold", 0, "log requests taking longer than this, with their slowest lookups (0 to disable)")
+	flag.DurationVar(&lookupDeadline, "lookup-deadline", lookupDeadline, "time allowed for all of a request's DNS lookups together (0 for no limit)")
+	flag.DurationVar(&probeTimeout, "probe-timeout", probeTimeout, "timeout for each XMPP stream opened by probe=true")
+	flag.DurationVar(&rttTimeout, "rtt-timeout", rttTimeout, "timeout for each connection timed by order=rtt")
+	flag.DurationVar(&hintsTimeout, "hints-timeout", hintsTimeout, "time allowed for the lookups made by hints=true")
+	flag.DurationVar(&hostMetaTimeout, "host-meta-timeout", hostMetaTimeout, "timeout for fetching a host-meta document with web=true")
+	flag.DurationVar(&tlsCheckTimeout, "tls-check-timeout", tlsCheckTimeout, "timeout for each connection made by tlscheck=true")
+	flag.BoolVar(&debugErrors, "debug-errors", false, "include the underlying error in every error response, for debugging; never use in production")
+	signatureKeyFile := flag.String("signature-key-file", "", "file containing a key to sign each response's records with, in the X-Records-Signature header, which is then also exposed to cross-origin scripts (disabled if empty)")
+	flag.StringVar(&adminToken, "admin-token", "", "bearer token granting access to diagnostic options (disabled if empty)")
+	flag.BoolVar(&implicitFallback, "fallback", false, "add the domain itself on the default port for each role without SRV records, as RFC 6120 has clients do, unless a request sets fallback=false")
+	flag.BoolVar(&nonAuthoritativeStatus, "status-203", false, "respond 203 Non-Authoritative Information instead of 200 when the response was cached or includes data from outside DNS")
+	flag.IntVar(&maxRespectedTTL, "max-respected-ttl", maxRespectedTTL, "maximum seconds a response may be cached, here and by clients, however long its records' TTLs; lower values pick up zone changes sooner at the cost of more lookups")
+	cacheSize := flag.Int("cache-size", 10000, "maximum number of responses to cache in memory (0 to disable caching)")
+	cacheBytes := flag.Int64("cache-max-bytes", 64<<20, "maximum bytes of responses to cache in memory, evicting the least recently used beyond it (0 for no limit)")
+	redisURL := flag.String("redis-url", "", "redis://[[user]:password@]host[:port][/db] of a Redis server to cache responses in, instead of memory")
+	redisTimeout := flag.Duration("redis-timeout", 250*time.Millisecond, "timeout for each Redis operation")
+	rateLimit := flag.Float64("rate-limit", 0, "requests per second allowed from each client (0 for no limit)")
+	clientConcurrencyLimit := flag.Int("max-client-concurrency", 32, "requests each client may have in flight at once, beyond which they get 429 (0 for no limit)")
+	clientConnectionLimit := flag.Int("max-client-connections", 64, "connections each peer other than -trusted-proxies may have open at once, beyond which they get 429 and are closed (0 for no limit)")
+	rateBurst := flag.Int("rate-burst", 20, "requests a client may make in a burst before being rate limited")
+	defaultFormatName := flag.String("default-format", defaultFormat.name, "format of responses to requests whose Accept header doesn't prefer one (json or msgpack)")
+	retryAfterFormat := flag.String("retry-after-format", "seconds", "format of the Retry-After header on rate limited requests (seconds or http-date)")
+	flag.BoolVar(&ssrfProtection, "ssrf-protection", ssrfProtection, "refuse to connect to internal addresses for tlscheck and probe")
+	flag.BoolVar(&filterInternalAddresses, "filter-internal-addresses", false, "leave internal addresses out of those returned by resolve=true")
+	trusted := flag.String("trusted-networks", "", "comma-separated addresses or CIDR networks exempt from -ssrf-protection and -filter-internal-addresses")
+	proxies := flag.String("trusted-proxies", "", "comma-separated addresses or CIDR networks of proxies whose X-Forwarded-For is trusted")
+	subdomains := flag.String("conventional-subdomains", strings.Join(conventionalSubdomains, ","), fmt.Sprintf("comma-separated subdomains tried in order by probe-subdomains=true (at most %d)", maxConventionalSubdomains))
+	search := flag.String("search-domains", "", "comma-separated domains to append to names that have no records of their own")
+	flag.IntVar(&maxBatchSize, "max-batch-size", maxBatchSize, "maximum number of domains in a batch request")
+	flag.IntVar(&batchConcurrency, "batch-concurrency", batchConcurrency, "number of domains in a batch resolved concurrently")
+	topDomains := flag.Int("metrics-top-domains", 20, "number of most requested domains to report individually in metrics (0 to disable)")
+	exposeHeaders := flag.String("cors-expose-headers", strings.Join(corsExposedHeaders, ","), "comma-separated response headers cross-origin scripts may read, such as ETag, X-Cache or X-Records-Signature")
+	flag.StringVar(&docsURL, "docs-url", "", "URL to redirect browsers requesting / to")
+	dnsQPS := flag.Float64("dns-qps", 0, "maximum DNS lookups per second across the whole service (0 for no limit)")
+	dnsQueueTimeout := flag.Duration("dns-queue-timeout", 250*time.Millisecond, "how long a lookup may wait for the -dns-qps budget before the request fails with 503")
+	allow := flag.String("allow-domains", "", "comma-separated domains, or *.suffix patterns, that are the only ones resolved; @file reads them one per line")
+	deny := flag.String("deny-domains", "", "comma-separated domains, or *.suffix patterns, that are never resolved; @file reads them one per line")
+	warmup := flag.Bool("warmup", false, "make a few throwaway lookups at startup to warm up the resolvers, reporting not ready on /readyz until they finish")
+	warmupTimeout := flag.Duration("warmup-timeout", 5*time.Second, "time allowed for -warmup before reporting ready anyway (0 for no limit)")
+	capabilities := flag.String("capability-names", "", "comma-separated attributes of _xmppconnect TXT records, other than alternatives, to return as capabilities, such as operators' version hints (none if empty)")
+	allowTargets := flag.String("allow-targets", "", "comma-separated domains, or *.suffix patterns, that are the only server targets returned, to guard against poisoned or hijacked zones; @file reads them one per line")
+	flag.StringVar(&duplicateParams, "duplicate-params", duplicateParams, "how to handle a parameter given more than once: reject with 400, or use the first or last value")
+	reverseSize := flag.Int("reverse-index-size", 10000, "number of resolved domains to remember the server targets of for /reverse (0 to disable)")
+	prewarmFile := flag.String("prewarm", "", "file of domains, one per line, to resolve into the cache at startup")
+	prewarmTimeout := flag.Duration("prewarm-timeout", 2*time.Minute, "time allowed for prewarming before giving up (0 for no limit)")
+	prewarmWait := flag.Bool("prewarm-wait", true, "report not ready on /readyz until prewarming finishes or times out")
+	dnsServer := flag.String("resolver", "", "host:port of a DNS server to send all queries to, instead of the system resolver")
+	flag.Parse()
+
+	if *dnsServer != "" {
+		if _, _, err := net.SplitHostPort(*dnsServer); err != nil {
+			log.Fatalf("Invalid -resolver address: %v", err)
+		}
+
+		resolver = newResolver(*dnsServer)
+		wireClient.servers = []string{*dnsServer}
+	}
+
+	if *dnsQPS > 0 {
+		outboundLimiter = newQueryLimiter(*dnsQPS, *dnsQueueTimeout)
 	}
 
-	for i, service := range srv {
-		res.Data.Servers[i] = &server{
-			Target:   service.Target,
-			Port:     service.Port,
-			Priority: service.Priority,
-			Weight:   service.Weight,
+	if *maxLookups > 0 {
+		lookupSlots = make(chan struct{}, *maxLookups)
+	}
+
+	var err error
+	if enabledTransports, err = parseTransports(*transports, *experimental); err != nil {
+		log.Fatal(err)
+	}
+
+	for _, d := range strings.Split(*search, ",") {
+		if d = strings.Trim(strings.TrimSpace(d), "."); d != "" {
+			searchDomains = append(searchDomains, d)
 		}
 	}
 
-	for i, rec := range txt {
-		split := strings.SplitN(rec, "=", 2)
+	corsExposedHeaders = nil
+	for _, name := range strings.Split(*exposeHeaders, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			corsExposedHeaders = append(corsExposedHeaders, name)
+		}
+	}
 
-		name := split[0]
-		if !strings.HasPrefix(strings.ToLower(name), "_xmpp-client-") {
-			continue
+	conventionalSubdomains = nil
+	for _, sub := range strings.Split(*subdomains, ",") {
+		if sub = strings.Trim(strings.TrimSpace(sub), "."); sub != "" {
+			conventionalSubdomains = append(conventionalSubdomains, sub)
+		}
+	}
+
+	if len(conventionalSubdomains) > maxConventionalSubdomains {
+		log.Fatalf("Invalid -conventional-subdomains: at most %d may be given", maxConventionalSubdomains)
+	}
+
+	if allowedDomains, err = parseDomainPatterns(*allow); err != nil {
+		log.Fatalf("Invalid -allow-domains: %v", err)
+	}
+
+	if deniedDomains, err = parseDomainPatterns(*deny); err != nil {
+		log.Fatalf("Invalid -deny-domains: %v", err)
+	}
+
+	if capabilityNames, err = parseCapabilityNames(*capabilities); err != nil {
+		log.Fatalf("Invalid -capability-names: %v", err)
+	}
+
+	if allowedTargets, err = parseDomainPatterns(*allowTargets); err != nil {
+		log.Fatalf("Invalid -allow-targets: %v", err)
+	}
+
+	if *redisURL != "" {
+		backend, err := newRedisCache(*redisURL, *redisTimeout)
+		if err != nil {
+			log.Fatalf("Invalid -redis-url: %v", err)
 		}
 
-		name = name[13:]
+		responseCache = &cache{backend: backend}
+	} else if *cacheSize > 0 {
+		responseCache = &cache{backend: newMemoryCache(*cacheSize, *cacheBytes)}
+	}
+
+	if trustedProxies, err = parseNetworks(*proxies); err != nil {
+		log.Fatalf("Invalid -trusted-proxies: %v", err)
+	}
 
-		res.Data.Alternatives[i] = &alternative{
-			Name:  name,
-			Value: split[1],
+	if trustedNetworks, err = parseNetworks(*trusted); err != nil {
+		log.Fatalf("Invalid -trusted-networks: %v", err)
+	}
+
+	if *signatureKeyFile != "" {
+		if signatureKey, err = readSignatureKey(*signatureKeyFile); err != nil {
+			log.Fatalf("Invalid -signature-key-file: %v", err)
+		}
+
+		if len(signatureKey) == 0 {
+			log.Fatalf("Invalid -signature-key-file: the file is empty")
 		}
+
+		// Browser clients can only check signatures they can read.
+		exposeHeader(signatureHeader)
 	}
 
-	if len(res.Data.Servers) == 0 && len(res.Data.Alternatives) == 0 {
-		httpError(w, notFoundError, http.StatusNotFound)
-		return
+	if *rateLimit > 0 {
+		requestLimiter = newRateLimiter(*rateLimit, *rateBurst)
+	}
+
+	if *reverseSize > 0 {
+		reverseTargets = newReverseIndex(*reverseSize)
+	}
+
+	if *clientConcurrencyLimit > 0 {
+		clientLimiter = newClientConcurrency(*clientConcurrencyLimit)
+	}
+
+	if *clientConnectionLimit > 0 {
+		connectionLimiter = newPeerConnections(*clientConnectionLimit)
+	}
+
+	if defaultFormat = formats[*defaultFormatName]; defaultFormat == nil {
+		log.Fatalf("Invalid -default-format %q", *defaultFormatName)
+	}
+
+	switch duplicateParams {
+	case duplicatesReject:
+		usage.Notes = append(usage.Notes, "A parameter other than domain given more than once is rejected with 400.")
+	case duplicatesFirst:
+		usage.Notes = append(usage.Notes, "A parameter other than domain given more than once takes its first value.")
+	case duplicatesLast:
+		usage.Notes = append(usage.Notes, "A parameter other than domain given more than once takes its last value.")
+	default:
+		log.Fatalf("Invalid -duplicate-params %q; expected reject, first or last", duplicateParams)
+	}
+
+	switch *retryAfterFormat {
+	case "seconds":
+	case "http-date":
+		retryAfterDate = true
+	default:
+		log.Fatalf("Invalid -retry-after-format %q", *retryAfterFormat)
+	}
+
+	if *topDomains > 0 {
+		domainRequests = newTopCounter("xmppresolv_domain_requests_total", "Requests for each of the most requested domains, approximately.", "domain", *topDomains)
+	}
+
+	http.HandleFunc("/", rateLimited(serve))
+	http.HandleFunc("/batch", rateLimited(serveBatch))
+	http.HandleFunc("/rpc", rateLimited(serveRPC))
+	http.HandleFunc("/metrics", serveMetrics)
+	http.HandleFunc("/readyz", serveReady)
+	http.HandleFunc("/version", serveVersion)
+	http.HandleFunc("/admin/stats", serveStats)
+	http.HandleFunc("/reverse", serveReverse)
+
+	var domains []string
+	if *prewarmFile != "" {
+		if domains, err = readPrewarmFile(*prewarmFile); err != nil {
+			log.Fatalf("Error reading -prewarm file: %v", err)
+		}
 	}
 
-	sort.Sort(res.Data.Servers)
-	sort.Sort(res.Data.Alternatives)
+	// The resolvers are warmed up before prewarming, which benefits from it
+	// too.
+	go func() {
+		if *warmup {
+			warmUpResolvers(*warmupTimeout)
+		}
+
+		if *prewarmFile == "" || !*prewarmWait {
+			ready.Store(true)
+		}
+
+		if *prewarmFile != "" {
+			prewarm(domains, *prewarmTimeout)
+			ready.Store(true)
+		}
+	}()
 
-	encoded, err := json.Marshal(res)
+	addrs, err := parseListenAddrs(*listen)
 	if err != nil {
-		log.Fatalf("Error marshalling JSON for %q: %v", domain, err)
+		log.Fatalf("Invalid -listen: %v", err)
 	}
 
-	hash := crc64.Checksum(encoded, crcTable)
+	// Every listener can fail without blocking, so that each error is
+	// logged.
+	var (
+		servers []*http.Server
+		errs    = make(chan error, len(addrs))
+	)
 
-	h.Set("ETag", "\""+strconv.FormatUint(hash, 16)+"\"")
+	for _, addr := range addrs {
+		srv := &http.Server{Addr: addr}
+		servers = append(servers, srv)
 
-	content := bytes.NewReader(encoded)
-	http.ServeContent(w, r, domain, time.Time{}, content)
+		go func() {
+			if err := listenAndServe(srv); err != http.ErrServerClosed {
+				errs <- fmt.Errorf("listening on %s: %v", srv.Addr, err)
+			}
+		}()
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	failed := false
+	select {
+	case err := <-errs:
+		log.Print(err)
+		failed = true
+	case sig := <-signals:
+		log.Printf("Received %v, shutting down", sig)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, srv := range servers {
+		wg.Add(1)
+		go func(srv *http.Server) {
+			defer wg.Done()
+			if err := srv.Shutdown(ctx); err != nil {
+				log.Printf("Error shutting down %s: %v", srv.Addr, err)
+			}
+		}(srv)
+	}
+	wg.Wait()
+
+	// Other listeners may have failed too, such as on the same address.
+	for len(errs) > 0 {
+		log.Print(<-errs)
+		failed = true
+	}
+
+	if failed {
+		os.Exit(1)
+	}
 }
 
-func main() {
-	log.SetFlags(log.Lshortfile)
+// listenAndServe is like srv.ListenAndServe, with the connections of each
+// peer limited by connectionLimiter, if set.
+func listenAndServe(srv *http.Server) error {
+	if connectionLimiter == nil {
+		return srv.ListenAndServe()
+	}
 
-	http.HandleFunc("/", serve)
+	l, err := net.Listen("tcp", srv.Addr)
+	if err != nil {
+		return err
+	}
+
+	return srv.Serve(connectionLimiter.listener(l))
+}
+
+// parseListenAddrs parses the comma-separated -listen addresses. An empty
+// one, such as from a trailing comma, is refused rather than listening on
+// port 80 of every interface.
+func parseListenAddrs(list string) ([]string, error) {
+	var addrs []string
+	for _, addr := range strings.Split(list, ",") {
+		if addr = strings.TrimSpace(addr); addr == "" {
+			return nil, fmt.Errorf("empty address in %q", list)
+		}
+
+		addrs = append(addrs, addr)
+	}
 
-	log.Fatal(http.ListenAndServe("127.0.0.1:8080", nil))
+	return addrs, nil
 }
@@ -0,0 +1,463 @@
+// Copyright 2015 Michael Johnson. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"hash/crc64"
+	"hash/fnv"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// get makes a request for target, a path and query, to serve.
+func get(t *testing.T, target string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	serve(w, httptest.NewRequest("GET", target, nil))
+
+	return w
+}
+
+// getData makes a request like get, failing the test unless it succeeds, and
+// returns the response's data.
+func getData(t *testing.T, target string) *responseData {
+	t.Helper()
+
+	w := get(t, target)
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET %s: status %d, body %s", target, w.Code, w.Body)
+	}
+
+	var resp struct {
+		Data *responseData `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || resp.Data == nil {
+		t.Fatalf("GET %s: invalid body %s: %v", target, w.Body, err)
+	}
+
+	return resp.Data
+}
+
+// useTransports enables the named transports until the test ends.
+func useTransports(t *testing.T, names string) {
+	t.Helper()
+
+	saved := enabledTransports
+	transports, err := parseTransports(names, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	enabledTransports = transports
+	t.Cleanup(func() { enabledTransports = saved })
+}
+
+func TestServeFixtures(t *testing.T) {
+	useTransports(t, "tcp,tls")
+	useFixtures(t,
+		srvFixture("_xmpp-client._tcp.example.test", 5, 10, 5222, "xmpp.example.test"),
+		srvFixture("_xmpps-client._tcp.example.test", 5, 0, 5223, "xmpp.example.test"),
+		txtFixture("_xmppconnect.example.test", 120, "_xmpp-client-websocket=wss://xmpp.example.test", "/ws"),
+		srvFixture("_xmpp-client._tcp.disabled.test", 0, 0, 0, "."),
+		srvFixture("_xmpp-client._tcp.zero.test", 0, 0, 0, "xmpp.zero.test"),
+		srvFixture("_xmpp-client._tcp.badtxt.test", 0, 0, 5222, "xmpp.badtxt.test"),
+		fixture{"_xmppconnect.badtxt.test", dnsTypeTXT, 60, []byte{20, 'a', 'b'}},
+	)
+
+	t.Run("direct TLS and multi-string TXT", func(t *testing.T) {
+		data := getData(t, "/example.test?fields=target,port,transport")
+
+		if len(data.Servers) != 2 {
+			t.Fatalf("servers = %d, want 2", len(data.Servers))
+		}
+		// Direct TLS servers have the tls transport.
+		transports := map[uint16]string{}
+		for _, s := range data.Servers {
+			transports[s.Port] = s.Transport
+		}
+		if transports[5222] != "" || transports[5223] != "tls" {
+			t.Errorf("transports by port = %v, want 5223 as tls", transports)
+		}
+
+		if len(data.Alternatives) != 1 || data.Alternatives[0].Value != "wss://xmpp.example.test/ws" {
+			t.Errorf("alternatives = %+v, want the TXT strings joined", data.Alternatives)
+		}
+	})
+
+	t.Run("TTL", func(t *testing.T) {
+		w := get(t, "/example.test")
+		if got, want := w.Header().Get("Cache-Control"), "public, max-age=120"; got != want {
+			t.Errorf("Cache-Control = %q, want %q", got, want)
+		}
+	})
+
+	t.Run("dot target", func(t *testing.T) {
+		w := get(t, "/disabled.test")
+		if w.Code != http.StatusNotFound || w.Body.String() != serviceDisabledError+"\n" {
+			t.Errorf("status %d, body %s; want the service disabled 404", w.Code, w.Body)
+		}
+	})
+
+	t.Run("zero port", func(t *testing.T) {
+		data := getData(t, "/zero.test?validate=true")
+		if len(data.Servers) != 1 || data.Servers[0].Port != 0 {
+			t.Fatalf("servers = %+v, want the port 0 server", data.Servers)
+		}
+		if len(data.Findings) != 1 || data.Findings[0].Message != "Port 0 cannot be connected to." {
+			t.Errorf("findings = %+v, want one about port 0", data.Findings)
+		}
+	})
+
+	t.Run("malformed TXT", func(t *testing.T) {
+		if w := get(t, "/badtxt.test"); w.Code != http.StatusInternalServerError {
+			t.Errorf("status %d, body %s; want 500", w.Code, w.Body)
+		}
+	})
+}
+
+func TestServeTruncated(t *testing.T) {
+	var fixtures []fixture
+	for i := 0; i < 20; i++ {
+		fixtures = append(fixtures, srvFixture("_xmpp-client._tcp.big.test", 0, 0, 5222, fmt.Sprintf("server-%02d.big.test", i)))
+	}
+
+	s := useFixtures(t, fixtures...)
+	s.truncateUDP(512)
+
+	data := getData(t, "/big.test")
+	if len(data.Servers) != 20 {
+		t.Errorf("servers = %d, want all 20 over TCP", len(data.Servers))
+	}
+
+	tcp := false
+	for _, q := range s.queried() {
+		tcp = tcp || q == "tcp _xmpp-client._tcp.big.test."
+	}
+	if !tcp {
+		t.Errorf("queries = %v, want a TCP retry", s.queried())
+	}
+}
+
+func TestDiagnostic(t *testing.T) {
+	tests := []struct {
+		query string
+		want  bool
+	}{
+		{"", false},
+		{"validate=true", false},
+		{"resolver=192.0.2.1:53", true},
+		{"class=CH", true},
+		{"debug=dns", true},
+		{"order=rtt", true},
+		{"validate=true&tlscheck=true", true},
+		{"validate=true&probe=true", true},
+	}
+
+	for _, tt := range tests {
+		query, err := url.ParseQuery(tt.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		opts, err := parseOptions(query)
+		if err != nil {
+			t.Errorf("%q: %v", tt.query, err)
+			continue
+		}
+
+		if got := opts.diagnostic(); got != tt.want {
+			t.Errorf("%q: diagnostic() = %t, want %t", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestAlternativeDedup(t *testing.T) {
+	const name = "_xmpp-client-websocket"
+	list := alternativeList{
+		{Name: name, Value: "wss://b.example.test/ws", Source: sourceTXT},
+		{Name: name, Value: "wss://a.example.test/ws", Source: sourceHostMeta},
+		{Name: name, Value: "wss://a.example.test/ws", Source: sourceTXT},
+		{Name: name, Value: "wss://b.example.test/ws", Source: sourceTXT},
+	}
+	sort.Stable(list)
+
+	var got []string
+	for _, alt := range list.dedup() {
+		got = append(got, alt.Value+" "+alt.Source)
+	}
+
+	// Distinct URLs are both kept, and of duplicates the TXT one is.
+	want := []string{"wss://a.example.test/ws txt", "wss://b.example.test/ws txt"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("dedup = %q, want %q", got, want)
+	}
+}
+
+func TestServeSameAlternativeName(t *testing.T) {
+	useFixtures(t,
+		srvFixture("_xmpp-client._tcp.example.test", 0, 0, 5222, "xmpp.example.test"),
+		txtFixture("_xmppconnect.example.test", 60, "_xmpp-client-websocket=wss://a.example.test/ws"),
+		txtFixture("_xmppconnect.example.test", 60, "_xmpp-client-websocket=wss://b.example.test/ws"),
+		txtFixture("_xmppconnect.example.test", 60, "_xmpp-client-websocket=wss://a.example.test/ws"),
+	)
+
+	data := getData(t, "/example.test")
+
+	var got []string
+	for _, alt := range data.Alternatives {
+		got = append(got, alt.Value)
+	}
+
+	if want := []string{"wss://a.example.test/ws", "wss://b.example.test/ws"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("alternatives = %q, want %q", got, want)
+	}
+}
+
+// BenchmarkETag compares etagFor, using SHA-256, with the CRC-64 it replaced
+// and FNV on a typical response.
+func BenchmarkETag(b *testing.B) {
+	data := &responseData{}
+	for i := 0; i < 4; i++ {
+		data.Servers = append(data.Servers, &server{
+			Target:   fmt.Sprintf("xmpp%d.example.test", i),
+			Port:     5222,
+			Priority: uint16(i),
+			Weight:   10,
+			Source:   sourceSRV,
+		})
+	}
+	data.Alternatives = alternativeList{
+		{Name: "_xmpp-client-websocket", Value: "wss://xmpp.example.test/ws", Source: sourceTXT},
+		{Name: "_xmpp-client-xbosh", Value: "https://xmpp.example.test/http-bind", Source: sourceTXT},
+	}
+	encoded := []byte(mustJSONEncode(&response{Version: apiVersion, Data: data}))
+
+	crcTable := crc64.MakeTable(crc64.ISO)
+	hashes := []struct {
+		name string
+		sum  func([]byte)
+	}{
+		{"etagFor", func(b []byte) { etagFor(b) }},
+		{"SHA-256", func(b []byte) { sha256.Sum256(b) }},
+		{"CRC-64", func(b []byte) { crc64.Checksum(b, crcTable) }},
+		{"FNV-1a-128", func(b []byte) {
+			h := fnv.New128a()
+			h.Write(b)
+			h.Sum(nil)
+		}},
+	}
+
+	for _, h := range hashes {
+		b.Run(h.name, func(b *testing.B) {
+			b.SetBytes(int64(len(encoded)))
+			for i := 0; i < b.N; i++ {
+				h.sum(encoded)
+			}
+		})
+	}
+}
+
+func TestDuplicateParams(t *testing.T) {
+	defer func() { duplicateParams = duplicatesReject }()
+
+	tests := []struct {
+		mode, query string
+		want        string
+	}{
+		{duplicatesReject, "type=client&type=server", "The type parameter was given more than once."},
+		{duplicatesReject, "type=server&resolve=true&resolve=false", "The resolve parameter was given more than once."},
+		{duplicatesReject, "type=server&type=server", "The type parameter was given more than once."},
+		{duplicatesReject, "type=server&domain=a.test&domain=b.test", "type=server resolve=false"},
+		{duplicatesFirst, "type=client&type=server&resolve=true&resolve=false", "type=client resolve=true"},
+		{duplicatesLast, "type=client&type=server&resolve=true&resolve=false", "type=server resolve=false"},
+		// Only the value used is validated.
+		{duplicatesFirst, "type=server&type=bogus", "type=server resolve=false"},
+	}
+
+	for _, tt := range tests {
+		duplicateParams = tt.mode
+
+		query, err := url.ParseQuery(tt.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var got string
+		if opts, err := parseOptions(query); err != nil {
+			got = err.Error()
+		} else {
+			got = fmt.Sprintf("type=%s resolve=%t", opts.serviceType, opts.resolve)
+		}
+
+		if got != tt.want {
+			t.Errorf("%s, %q: got %q, want %q", tt.mode, tt.query, got, tt.want)
+		}
+	}
+
+	duplicateParams = duplicatesReject
+	if w := get(t, "/example.test?type=client&type=server"); w.Code != http.StatusBadRequest {
+		t.Errorf("status %d, want 400", w.Code)
+	}
+}
+
+func TestWithRoles(t *testing.T) {
+	clients := serverList{
+		{Target: "c1.", Priority: 10},
+		{Target: "c2.", Priority: 20},
+		{Target: "c3.", Priority: 20},
+	}
+	s2s := serverList{
+		{Target: "s1.", Priority: 5},
+		{Target: "s2.", Priority: 20},
+	}
+
+	list := withRoles(append(serverList(nil), clients...), append(serverList(nil), s2s...), false)
+
+	var got []string
+	for _, s := range list {
+		got = append(got, s.Target+" "+s.Role)
+	}
+
+	// Roles interleave by priority, clients first among equals and each
+	// role in its own order.
+	want := []string{"s1. server", "c1. client", "c2. client", "c3. client", "s2. server"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("withRoles = %q, want %q", got, want)
+	}
+
+	gotClients, gotS2S := list.splitRoles()
+	if !reflect.DeepEqual(gotClients, clients) || !reflect.DeepEqual(gotS2S, s2s) {
+		t.Errorf("splitRoles = %v, %v; want the lists given to withRoles", gotClients, gotS2S)
+	}
+}
+
+func TestServeBoth(t *testing.T) {
+	useFixtures(t,
+		srvFixture("_xmpp-client._tcp.example.test", 10, 0, 5222, "c2s.example.test"),
+		srvFixture("_xmpp-server._tcp.example.test", 5, 0, 5269, "s2s.example.test"),
+	)
+
+	data := getData(t, "/example.test?type=both")
+	if len(data.S2SServers) != 0 {
+		t.Errorf("s2sServers = %+v, want them in servers", data.S2SServers)
+	}
+
+	var got []string
+	for _, s := range data.Servers {
+		got = append(got, s.Target+" "+s.Role)
+	}
+
+	if want := []string{"s2s.example.test. server", "c2s.example.test. client"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("servers = %q, want %q", got, want)
+	}
+}
+
+func TestServeIDNAlternatives(t *testing.T) {
+	useFixtures(t,
+		srvFixture("_xmpp-client._tcp.example.test", 0, 0, 5222, "xmpp.example.test"),
+		txtFixture("_xmppconnect.example.test", 60, "_xmpp-client-websocket=wss://bücher.example:5281/ws"),
+		txtFixture("_xmppconnect.example.test", 60, "_xmpp-client-xbosh=https://xn--bcher-kva.example/http-bind"),
+	)
+
+	want := map[string]string{
+		"websocket": "wss://xn--bcher-kva.example:5281/ws",
+		"xbosh":     "https://xn--bcher-kva.example/http-bind",
+	}
+
+	for _, target := range []string{"/example.test", "/example.test?unicode=true"} {
+		data := getData(t, target)
+		if len(data.Alternatives) != len(want) {
+			t.Fatalf("%s: alternatives = %+v, want %d", target, data.Alternatives, len(want))
+		}
+
+		// Both hosts are given in ASCII, and in Unicode if asked for.
+		wantUnicode := ""
+		if target != "/example.test" {
+			wantUnicode = "bücher.example"
+		}
+
+		for _, alt := range data.Alternatives {
+			if alt.Value != want[alt.Name] {
+				t.Errorf("%s: %s = %q, want %q", target, alt.Name, alt.Value, want[alt.Name])
+			}
+
+			if alt.HostUnicode != wantUnicode {
+				t.Errorf("%s: %s hostUnicode = %q, want %q", target, alt.Name, alt.HostUnicode, wantUnicode)
+			}
+		}
+	}
+}
+
+func TestDeprecatedParams(t *testing.T) {
+	useFixtures(t, srvFixture("_xmpp-client._tcp.example.test", 0, 0, 5222, "xmpp.example.test"))
+
+	deprecatedParams["rank"] = "rank is deprecated."
+	deprecatedParams["type=both"] = "type=both is deprecated; use type=all."
+	defer func() {
+		delete(deprecatedParams, "rank")
+		delete(deprecatedParams, "type=both")
+	}()
+
+	both := []string{`299 xmppresolv "rank is deprecated."`, `299 xmppresolv "type=both is deprecated; use type=all."`}
+
+	rpc := httptest.NewRequest("POST", "/rpc", strings.NewReader(`[
+		{"jsonrpc": "2.0", "method": "resolve", "params": {"domain": "example.test", "options": {"rank": true, "type": "both"}}, "id": 1},
+		{"jsonrpc": "2.0", "method": "resolve", "params": {"domain": "example.test", "options": {"rank": false}}, "id": 2}
+	]`))
+
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		r       *http.Request
+		want    []string
+	}{
+		{"bare name", serve, httptest.NewRequest("GET", "/example.test?rank=true", nil), both[:1]},
+		{"name=value", serve, httptest.NewRequest("GET", "/example.test?type=both", nil), both[1:]},
+		{"other value", serve, httptest.NewRequest("GET", "/example.test?type=all", nil), nil},
+		{"both", serve, httptest.NewRequest("GET", "/example.test?type=both&rank=false", nil), both},
+		{"batch", serveBatch, httptest.NewRequest("GET", "/batch?domain=example.test&type=both&rank=true", nil), both},
+		{"rpc", serveRPC, rpc, both},
+	}
+
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		tt.handler(w, tt.r)
+
+		if got := w.Header().Values("Warning"); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: Warning = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	serveRoot(w, httptest.NewRequest("GET", "/", nil))
+
+	var root struct {
+		Usage apiUsage `json:"usage"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &root); err != nil || root.Usage.Deprecated["type=both"] == "" {
+		t.Errorf("usage = %s, want the deprecated parameters", w.Body)
+	}
+}
+
+func TestParseListenAddrs(t *testing.T) {
+	if addrs, err := parseListenAddrs("127.0.0.1:8080, [::1]:8080"); err != nil || !reflect.DeepEqual(addrs, []string{"127.0.0.1:8080", "[::1]:8080"}) {
+		t.Errorf("parseListenAddrs = %q, %v", addrs, err)
+	}
+
+	for _, list := range []string{"", "127.0.0.1:8080,", "127.0.0.1:8080, ,[::1]:8080"} {
+		if addrs, err := parseListenAddrs(list); err == nil {
+			t.Errorf("parseListenAddrs(%q) = %q, want an error", list, addrs)
+		}
+	}
+}